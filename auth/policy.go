@@ -0,0 +1,77 @@
+package auth
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxPasswordBytes: bcrypt учитывает только первые 72 байта пароля, остальное
+// молча отбрасывается.
+const MaxPasswordBytes = 72
+
+//go:embed common-passwords.txt
+var commonPasswordsList string
+
+var commonPasswords = func() map[string]struct{} {
+	set := map[string]struct{}{}
+	for _, line := range strings.Split(commonPasswordsList, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			set[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return set
+}()
+
+// PasswordPolicy — минимальная длина пароля и сколько классов символов
+// (строчные, заглавные, цифры, прочие) должно в нём встречаться.
+type PasswordPolicy struct {
+	MinLength  int
+	MinClasses int
+}
+
+// ValidatePassword проверяет пароль по политике и возвращает сообщение для
+// клиента или "". identity — email или логин пользователя: пароль не должен
+// содержать логин или часть email до «@».
+func ValidatePassword(password, identity string, policy PasswordPolicy) string {
+	if len(password) > MaxPasswordBytes {
+		return fmt.Sprintf("Password must be at most %d bytes", MaxPasswordBytes)
+	}
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return fmt.Sprintf("Password must be at least %d characters", policy.MinLength)
+	}
+
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	if classes < policy.MinClasses {
+		return fmt.Sprintf("Password must contain at least %d of: lowercase, uppercase, digits, symbols", policy.MinClasses)
+	}
+
+	lowered := strings.ToLower(password)
+	if _, ok := commonPasswords[lowered]; ok {
+		return "Password is too common"
+	}
+	if name, _, _ := strings.Cut(identity, "@"); len(name) >= 3 && strings.Contains(lowered, strings.ToLower(name)) {
+		return "Password must not contain your email or login"
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePassword(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MinClasses: 2}
+	tests := []struct {
+		password, identity, want string
+	}{
+		{"correct horse 42", "alice@example.com", ""},
+		{"short1", "alice@example.com", "Password must be at least 8 characters"},
+		// Длина считается в символах, а не байтах
+		{"пароль12", "alice@example.com", ""},
+		{"onlylowercase", "alice@example.com", "Password must contain at least 2 of: lowercase, uppercase, digits, symbols"},
+		// Список распространённых паролей сверяется без учёта регистра
+		{"PassWord1", "alice@example.com", "Password is too common"},
+		{"Password123", "alice@example.com", "Password is too common"},
+		{"my-Alice-pass", "alice@example.com", "Password must not contain your email or login"},
+		{"bobcat-42x", "bob", "Password must not contain your email or login"},
+		// Слишком короткая часть до «@» не проверяется
+		{"secret-ab-1", "ab@example.com", ""},
+		{strings.Repeat("a1", 37), "alice@example.com", "Password must be at most 72 bytes"},
+		// 72 байта — ещё можно, даже если это 36 кириллических символов
+		{strings.Repeat("ж", 35) + "1", "alice@example.com", ""},
+		{strings.Repeat("ж", 36) + "1", "alice@example.com", "Password must be at most 72 bytes"},
+	}
+	for _, tt := range tests {
+		if got := ValidatePassword(tt.password, tt.identity, policy); got != tt.want {
+			t.Errorf("ValidatePassword(%q, %q) = %q, want %q", tt.password, tt.identity, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePasswordPolicy(t *testing.T) {
+	strict := PasswordPolicy{MinLength: 12, MinClasses: 3}
+	if got := ValidatePassword("abcdefgh12", "", strict); got != "Password must be at least 12 characters" {
+		t.Errorf("got %q", got)
+	}
+	if got := ValidatePassword("abcdefgh1234", "", strict); got != "Password must contain at least 3 of: lowercase, uppercase, digits, symbols" {
+		t.Errorf("got %q", got)
+	}
+	if got := ValidatePassword("abcdefgh123!", "", strict); got != "" {
+		t.Errorf("got %q", got)
+	}
+}
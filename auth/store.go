@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+)
+
+// Schema создаёт общую таблицу users и журнал неудачных входов. Выполняется
+// каждым сервисом при запуске до его собственных таблиц и приводит к общему
+// виду таблицы, созданные прежними версиями: sem13-14 хранил хэш в password,
+// у sem15-16 не было email, а журнал неудач был у каждого со своей колонкой.
+const Schema = `
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    email TEXT,
+    login TEXT,
+    password_hash TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'password') THEN
+        ALTER TABLE users RENAME COLUMN password TO password_hash;
+    END IF;
+END $$;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS login TEXT;
+ALTER TABLE users ALTER COLUMN email DROP NOT NULL;
+ALTER TABLE users ALTER COLUMN login DROP NOT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'viewer'
+    CHECK (role IN ('viewer', 'editor', 'admin'));
+-- Уже зарегистрированные пользователи считаются подтверждёнными
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ DEFAULT NOW();
+ALTER TABLE users ALTER COLUMN email_verified_at DROP DEFAULT;
+-- У прежних таблиц уникальность уже задана ограничениями users_email_key и users_login_key
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users(email);
+CREATE UNIQUE INDEX IF NOT EXISTS users_login_key ON users(login);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'users_identifier_check') THEN
+        ALTER TABLE users ADD CONSTRAINT users_identifier_check CHECK (email IS NOT NULL OR login IS NOT NULL);
+    END IF;
+END $$;
+
+-- Адреса и логины хранятся нормализованными. Если после нормализации два
+-- аккаунта совпадают, миграция останавливается: какой из них оставить,
+-- решает администратор, молча пропускать такие строки нельзя.
+DO $$
+DECLARE
+    conflicts TEXT;
+BEGIN
+    SELECT string_agg(format('%s %L (ids %s)', kind, value, ids), '; ') INTO conflicts
+    FROM (
+        SELECT 'email' AS kind, LOWER(TRIM(email)) AS value, string_agg(id::TEXT, ', ' ORDER BY id) AS ids
+        FROM users WHERE email IS NOT NULL
+        GROUP BY LOWER(TRIM(email)) HAVING COUNT(*) > 1
+        UNION ALL
+        SELECT 'login', LOWER(TRIM(login)), string_agg(id::TEXT, ', ' ORDER BY id)
+        FROM users WHERE login IS NOT NULL
+        GROUP BY LOWER(TRIM(login)) HAVING COUNT(*) > 1
+    ) duplicates;
+    IF conflicts IS NOT NULL THEN
+        RAISE EXCEPTION 'users differ only by case or surrounding spaces, merge or rename them before upgrading: %', conflicts;
+    END IF;
+END $$;
+
+UPDATE users SET email = LOWER(TRIM(email)) WHERE email <> LOWER(TRIM(email));
+UPDATE users SET login = LOWER(TRIM(login)) WHERE login <> LOWER(TRIM(login));
+
+CREATE TABLE IF NOT EXISTS login_failures (
+    id BIGSERIAL PRIMARY KEY,
+    identifier TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+DO $$
+DECLARE
+    legacy TEXT;
+BEGIN
+    SELECT column_name INTO legacy FROM information_schema.columns
+    WHERE table_schema = current_schema() AND table_name = 'login_failures' AND column_name IN ('email', 'login');
+    IF legacy IS NOT NULL THEN
+        EXECUTE format('ALTER TABLE login_failures RENAME COLUMN %I TO identifier', legacy);
+    END IF;
+END $$;
+
+DROP INDEX IF EXISTS login_failures_email_idx;
+DROP INDEX IF EXISTS login_failures_login_idx;
+CREATE INDEX IF NOT EXISTS login_failures_identifier_idx ON login_failures(identifier, created_at)`
+
+const selectUser = `
+SELECT id, COALESCE(email, ''), COALESCE(login, ''), password_hash, role, email_verified_at, created_at
+FROM users`
+
+// Store — репозиторий пользователей.
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) get(ctx context.Context, where string, arg any) (*User, error) {
+	var u User
+	err := s.db.QueryRowContext(ctx, selectUser+" WHERE "+where, arg).Scan(
+		&u.ID, &u.Email, &u.Login, &u.PasswordHash, &u.Role, &u.EmailVerifiedAt, &u.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *Store) ByID(ctx context.Context, id int) (*User, error) {
+	return s.get(ctx, "id = $1", id)
+}
+
+// ByEmail и ByLogin ожидают уже нормализованное значение.
+func (s *Store) ByEmail(ctx context.Context, email string) (*User, error) {
+	return s.get(ctx, "email = $1", email)
+}
+
+func (s *Store) ByLogin(ctx context.Context, login string) (*User, error) {
+	return s.get(ctx, "login = $1", login)
+}
+
+// ByIdentifier ищет по логину или email: так в sem15-16 могут войти и
+// пользователи, зарегистрированные в sem13-14. Логин не может содержать «@»,
+// поэтому совпасть с чужим email он не может.
+func (s *Store) ByIdentifier(ctx context.Context, identifier string) (*User, error) {
+	return s.get(ctx, "login = $1 OR email = $1", identifier)
+}
+
+// Create сохраняет пользователя и заполняет ID, роль и время создания.
+// Пустая роль означает роль по умолчанию.
+func (s *Store) Create(ctx context.Context, u *User) error {
+	err := s.db.QueryRowContext(ctx, `
+        INSERT INTO users (email, login, password_hash, role, email_verified_at)
+        VALUES (NULLIF($1, ''), NULLIF($2, ''), $3, COALESCE(NULLIF($4, ''), 'viewer'), $5)
+        RETURNING id, role, created_at`,
+		u.Email, u.Login, u.PasswordHash, u.Role, u.EmailVerifiedAt,
+	).Scan(&u.ID, &u.Role, &u.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrUserExists
+	}
+	return err
+}
+
+// SetPassword заменяет хэш пароля.
+func (s *Store) SetPassword(ctx context.Context, id int, hash string) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET password_hash = $1 WHERE id = $2", hash, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// RecordLoginFailure пишет неудачную попытку входа в журнал login_failures.
+// Ошибка записи только логируется: журнал не должен мешать ответу.
+func (s *Store) RecordLoginFailure(ctx context.Context, identifier, ip, reason string) {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO login_failures (identifier, ip, reason) VALUES ($1, $2, $3)",
+		identifier, ip, reason,
+	)
+	if err != nil {
+		log.Printf("failed to record login failure: %v", err)
+	}
+}
+
+// isUniqueViolation распознаёт код 23505 без зависимости от конкретного драйвера.
+func isUniqueViolation(err error) bool {
+	var sqlErr interface{ SQLState() string }
+	return errors.As(err, &sqlErr) && sqlErr.SQLState() == "23505"
+}
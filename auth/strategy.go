@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"strconv"
+	"time"
+)
+
+// Стратегии закрепляют вход пользователя, уже прошедшего все проверки
+// (пароль, второй фактор, SSO): sem15-16 заводит серверную сессию, sem13-14
+// выпускает JWT. Фреймворк-зависимые детали — cookie, подпись токенов —
+// остаются в сервисах за небольшими интерфейсами.
+
+// Session — серверная сессия; *session.Session из fiber подходит как есть.
+type Session interface {
+	ID() string
+	Set(key string, value any)
+	Regenerate() error
+}
+
+// Ключи данных сессии, которые пишет SessionStrategy.
+const (
+	SessionUserKey = "userID"
+	SessionRoleKey = "role"
+)
+
+// SessionStrategy выдаёт сессии новый ID, чтобы ID, подсунутый заранее
+// (session fixation), не стал авторизованным, и записывает в неё пользователя.
+// Сохранить сессию и выставить cookie должен вызывающий.
+type SessionStrategy struct{}
+
+// Issue возвращает новый ID сессии.
+func (SessionStrategy) Issue(sess Session, u *User) (string, error) {
+	if err := sess.Regenerate(); err != nil {
+		return "", err
+	}
+	sess.Set(SessionUserKey, u.ID)
+	sess.Set(SessionRoleKey, u.Role)
+	return sess.ID(), nil
+}
+
+// TokenSigner подписывает claims токена типа typ со сроком ttl; ключи,
+// алгоритм, iss и aud выбирает сервис.
+type TokenSigner interface {
+	Sign(typ string, ttl time.Duration, claims map[string]any) (string, error)
+}
+
+const TokenTypeAccess = "access"
+
+// TokenStrategy выпускает access-токены: sub — ID пользователя, role — его роль,
+// auth_time — когда пользователь последний раз подтвердил личность (пароль или
+// вход у провайдера SSO), как одноимённый claim OpenID Connect.
+type TokenStrategy struct {
+	Signer TokenSigner
+	TTL    time.Duration
+}
+
+func (s TokenStrategy) Issue(u *User, authTime time.Time) (string, error) {
+	return s.Signer.Sign(TokenTypeAccess, s.TTL, map[string]any{
+		"sub":       strconv.Itoa(u.ID),
+		"role":      u.Role,
+		"auth_time": authTime.Unix(),
+	})
+}
@@ -0,0 +1,58 @@
+package totp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	RecoveryCodeCount = 10
+
+	// Без похожих друг на друга символов (0/o, 1/l/i): коды переписывают вручную.
+	recoveryAlphabet  = "abcdefghjkmnpqrstuvwxyz23456789"
+	recoveryGroupSize = 4
+	recoveryGroups    = 3
+)
+
+// GenerateRecoveryCodes возвращает n одноразовых кодов вида xxxx-xxxx-xxxx.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	buf := make([]byte, recoveryGroupSize*recoveryGroups)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		var sb strings.Builder
+		for j, b := range buf {
+			if j > 0 && j%recoveryGroupSize == 0 {
+				sb.WriteByte('-')
+			}
+			// 256 не делится на 31 нацело, но смещение распределения на 12 символах несущественно
+			sb.WriteByte(recoveryAlphabet[int(b)%len(recoveryAlphabet)])
+		}
+		codes[i] = sb.String()
+	}
+	return codes, nil
+}
+
+// NormalizeRecoveryCode убирает разделители и регистр, чтобы код принимался в любом написании.
+func NormalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '-' || r == ' ':
+			return -1
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return r
+	}, code)
+}
+
+// HashRecoveryCode — в базе хранятся только хэши. Коды случайные и длинные,
+// поэтому медленный хэш не нужен.
+func HashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(NormalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
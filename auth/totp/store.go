@@ -0,0 +1,236 @@
+package totp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrNotEnrolled    = errors.New("two-factor authentication setup was not started")
+	ErrNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrInvalidCode    = errors.New("invalid two-factor code")
+)
+
+// Schema создаёт таблицы второго фактора. Выполняется после создания users,
+// оба сервиса хранят пользователей в users(id).
+const Schema = `
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    -- NULL, пока пользователь не подтвердил настройку первым кодом
+    enabled_at TIMESTAMPTZ,
+    -- последний принятый интервал, защита от повторного использования кода
+    last_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, code_hash)
+)`
+
+// Store хранит секреты и коды восстановления пользователей.
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Status сообщает, включён ли второй фактор и сколько осталось неиспользованных кодов восстановления.
+func (s *Store) Status(ctx context.Context, userID int) (enabled bool, recoveryCodes int, err error) {
+	err = s.db.QueryRowContext(ctx, `
+        SELECT
+            EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL),
+            (SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL)`,
+		userID,
+	).Scan(&enabled, &recoveryCodes)
+	return enabled, recoveryCodes, err
+}
+
+// Setup начинает подключение: выдаёт новый секрет и otpauth-ссылку для QR-кода.
+// Второй фактор включается только после Enable с кодом из приложения.
+// Повторный Setup до подтверждения заменяет секрет.
+func (s *Store) Setup(ctx context.Context, userID int, issuer, account string) (secret, uri string, err error) {
+	secret, err = GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+        INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_step = 0, created_at = NOW()
+        WHERE user_totp.enabled_at IS NULL`,
+		userID, secret,
+	)
+	if err != nil {
+		return "", "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", "", ErrAlreadyEnabled
+	}
+	return secret, URI(issuer, account, secret), nil
+}
+
+// Enable подтверждает настройку кодом из приложения и выдаёт коды восстановления.
+// Коды показываются один раз, в базе остаются только их хэши.
+func (s *Store) Enable(ctx context.Context, userID int, code string) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		secret    string
+		enabledAt sql.NullTime
+		lastStep  int64
+	)
+	err = tx.QueryRowContext(ctx,
+		"SELECT secret, enabled_at, last_step FROM user_totp WHERE user_id = $1 FOR UPDATE",
+		userID,
+	).Scan(&secret, &enabledAt, &lastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		return nil, ErrAlreadyEnabled
+	}
+
+	matched, ok := Validate(secret, code, time.Now(), lastStep)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE user_totp SET enabled_at = NOW(), last_step = $1 WHERE user_id = $2",
+		matched, userID,
+	); err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Verify проверяет второй фактор при входе: TOTP-код или одноразовый код восстановления.
+func (s *Store) Verify(ctx context.Context, userID int, code string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		secret   string
+		lastStep int64
+	)
+	// Блокировка строки не даёт двум параллельным запросам принять один и тот же код
+	err = tx.QueryRowContext(ctx,
+		"SELECT secret, last_step FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL FOR UPDATE",
+		userID,
+	).Scan(&secret, &lastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotEnabled
+	}
+	if err != nil {
+		return err
+	}
+
+	if IsCode(code) {
+		matched, ok := Validate(secret, code, time.Now(), lastStep)
+		if !ok {
+			return ErrInvalidCode
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE user_totp SET last_step = $1 WHERE user_id = $2", matched, userID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE user_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID, HashRecoveryCode(code),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidCode
+	}
+	return tx.Commit()
+}
+
+// RegenerateRecoveryCodes заменяет все коды восстановления новыми.
+func (s *Store) RegenerateRecoveryCodes(ctx context.Context, userID int) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)",
+		userID,
+	).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotEnabled
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Disable отключает второй фактор и удаляет коды восстановления.
+func (s *Store) Disable(ctx context.Context, userID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int) ([]string, error) {
+	codes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, HashRecoveryCode(code),
+		); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
@@ -0,0 +1,101 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// Секрет из тестовых векторов RFC 6238 ("12345678901234567890" в base32)
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFCVectors(t *testing.T) {
+	// В RFC коды из 8 цифр, у нас — последние 6 из них
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+	}
+	for unix, want := range vectors {
+		got, err := Code(rfcSecret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("t=%d: got %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	for _, tt := range []struct {
+		offset time.Duration
+		ok     bool
+	}{
+		{0, true},
+		{-Period, true},
+		{Period, true},
+		{-2 * Period, false},
+		{2 * Period, false},
+	} {
+		code, _ := Code(rfcSecret, now.Add(tt.offset))
+		matched, ok := Validate(rfcSecret, code, now, 0)
+		if ok != tt.ok {
+			t.Errorf("offset %v: ok = %v, want %v", tt.offset, ok, tt.ok)
+		}
+		if ok && matched != step(now.Add(tt.offset)) {
+			t.Errorf("offset %v: matched step %d, want %d", tt.offset, matched, step(now.Add(tt.offset)))
+		}
+	}
+}
+
+func TestValidateReplay(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	code, _ := Code(rfcSecret, now)
+
+	last, ok := Validate(rfcSecret, code, now, 0)
+	if !ok {
+		t.Fatal("first use rejected")
+	}
+	if _, ok := Validate(rfcSecret, code, now, last); ok {
+		t.Fatal("same code accepted twice")
+	}
+	// И в следующем интервале, пока код ещё в окне
+	if _, ok := Validate(rfcSecret, code, now.Add(Period), last); ok {
+		t.Fatal("same code accepted in the next step")
+	}
+	// Код из прошлого интервала после использования более нового тоже не подходит
+	old, _ := Code(rfcSecret, now.Add(-Period))
+	if _, ok := Validate(rfcSecret, old, now, last); ok {
+		t.Fatal("older code accepted after a newer one")
+	}
+
+	next, _ := Code(rfcSecret, now.Add(Period))
+	if s, ok := Validate(rfcSecret, next, now.Add(Period), last); !ok || s != last+1 {
+		t.Fatalf("next code: step %d, ok %v", s, ok)
+	}
+}
+
+func TestValidateRejectsMalformed(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	code, _ := Code(rfcSecret, now)
+	for _, tt := range []struct{ secret, code string }{
+		{rfcSecret, "12345"},
+		{rfcSecret, "abcdef"},
+		{rfcSecret, code + "0"},
+		{"not base32!", code},
+	} {
+		if _, ok := Validate(tt.secret, tt.code, now, 0); ok {
+			t.Errorf("secret %q code %q accepted", tt.secret, tt.code)
+		}
+	}
+	if _, ok := Validate(rfcSecret, " "+code+" ", now, 0); !ok {
+		t.Error("code with surrounding spaces rejected")
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	if HashRecoveryCode("ABCD-EFGH") != HashRecoveryCode("abcd efgh") {
+		t.Error("recovery code hash depends on case or separators")
+	}
+}
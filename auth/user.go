@@ -0,0 +1,45 @@
+// Package auth — общая модель пользователя для сервисов sem13-14 (JWT) и
+// sem15-16 (сессии): таблица users, репозиторий, хэширование паролей и
+// стратегии закрепления входа. Оба сервиса могут работать с одной базой.
+package auth
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+// User — учётная запись. Пользователь входит по email (sem13-14, SSO) или
+// по логину (sem15-16); хотя бы одно из полей заполнено, второе может быть пустым.
+type User struct {
+	ID    int
+	Email string
+	Login string
+	// Пустой хэш — у аккаунта нет пароля, он входит только через SSO
+	PasswordHash    string
+	Role            string
+	EmailVerifiedAt *time.Time
+	CreatedAt       time.Time
+}
+
+// Name — как показывать пользователя: логин, а если его нет, email.
+func (u *User) Name() string {
+	if u.Login != "" {
+		return u.Login
+	}
+	return u.Email
+}
+
+// EmailVerified: для аккаунтов с email вход разрешён только после подтверждения адреса.
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// HasPassword: false для аккаунтов, созданных через SSO.
+func (u *User) HasPassword() bool {
+	return u.PasswordHash != ""
+}
@@ -0,0 +1,3 @@
+module mock-oidc
+
+go 1.23.5
@@ -0,0 +1,323 @@
+// Мок OpenID Connect провайдера для локальной разработки и проверки входа через SSO
+// без доступа к сети. Поддерживает authorization code + PKCE (S256): на странице
+// входа можно указать любой email, пароль не спрашивается. Только для разработки.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	codeTTL    = time.Minute
+	idTokenTTL = 10 * time.Minute
+)
+
+type authorization struct {
+	ClientID      string
+	RedirectURI   string
+	Challenge     string
+	Nonce         string
+	Email         string
+	Name          string
+	EmailVerified bool
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
+
+type provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+
+	kid string
+	key ed25519.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+func main() {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := &provider{
+		issuer:       strings.TrimSuffix(getEnv("ISSUER", "http://localhost/oidc"), "/"),
+		clientID:     getEnv("CLIENT_ID", "front2sem"),
+		clientSecret: getEnv("CLIENT_SECRET", "mock-client-secret"),
+		kid:          randomString(8),
+		key:          key,
+		codes:        map[string]authorization{},
+	}
+
+	http.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	http.HandleFunc("GET /jwks", p.jwks)
+	http.HandleFunc("GET /authorize", p.authorizeForm)
+	http.HandleFunc("POST /authorize", p.authorize)
+	http.HandleFunc("POST /token", p.token)
+
+	addr := getEnv("ADDR", ":9000")
+	log.Printf("mock OIDC provider %s listening on %s", p.issuer, addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
+
+func (p *provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"EdDSA"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+	})
+}
+
+func (p *provider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"alg": "EdDSA",
+			"use": "sig",
+			"kid": p.kid,
+			"x":   base64.RawURLEncoding.EncodeToString(p.key.Public().(ed25519.PublicKey)),
+		}},
+	})
+}
+
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>Mock SSO</title></head>
+<body style="font-family: Arial, sans-serif; max-width: 360px; margin: 60px auto;">
+<h2>Mock SSO</h2>
+<p>Sign in to <b>{{.ClientID}}</b> as any user.</p>
+<form method="post">
+    {{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+    {{end}}
+    <p><input type="email" name="email" placeholder="Email" required style="width: 100%"></p>
+    <p><input type="text" name="name" placeholder="Name" style="width: 100%"></p>
+    <p><label><input type="checkbox" name="email_verified" checked> Email verified</label></p>
+    <button type="submit">Sign in</button>
+</form>
+</body>
+</html>`))
+
+// validateAuthorizeRequest проверяет параметры запроса авторизации. Ошибки
+// показываются пользователю, а не отправляются на redirect_uri: ему ещё нельзя доверять.
+func (p *provider) validateAuthorizeRequest(q url.Values) string {
+	switch {
+	case q.Get("response_type") != "code":
+		return "response_type must be code"
+	case q.Get("client_id") != p.clientID:
+		return "unknown client_id"
+	case q.Get("redirect_uri") == "":
+		return "redirect_uri is required"
+	case !strings.Contains(" "+q.Get("scope")+" ", " openid "):
+		return "scope must include openid"
+	case q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256":
+		return "PKCE with S256 is required"
+	}
+	return ""
+}
+
+var authorizeParams = []string{"response_type", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method"}
+
+func (p *provider) authorizeForm(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if msg := p.validateAuthorizeRequest(q); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	params := map[string]string{}
+	for _, name := range authorizeParams {
+		params[name] = q.Get(name)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	authorizePage.Execute(w, map[string]any{"ClientID": p.clientID, "Params": params})
+}
+
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	f := r.PostForm
+	if msg := p.validateAuthorizeRequest(f); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(f.Get("email"))
+	if email == "" {
+		http.Error(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString(16)
+	p.mu.Lock()
+	p.codes[code] = authorization{
+		ClientID:      f.Get("client_id"),
+		RedirectURI:   f.Get("redirect_uri"),
+		Challenge:     f.Get("code_challenge"),
+		Nonce:         f.Get("nonce"),
+		Email:         email,
+		Name:          f.Get("name"),
+		EmailVerified: f.Get("email_verified") != "",
+		AuthTime:      time.Now(),
+		ExpiresAt:     time.Now().Add(codeTTL),
+	}
+	p.mu.Unlock()
+
+	target, err := url.Parse(f.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	q := target.Query()
+	q.Set("code", code)
+	if state := f.Get("state"); state != "" {
+		q.Set("state", state)
+	}
+	target.RawQuery = q.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, "invalid_request", "bad form")
+		return
+	}
+
+	// В Basic-авторизации client_id и секрет закодированы как в form-urlencoded (RFC 6749, 2.3.1)
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.clientSecret)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mock-oidc"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	// Код одноразовый: удаляется при первом предъявлении, даже неудачном
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	auth, found := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	switch {
+	case !found || time.Now().After(auth.ExpiresAt):
+		oauthError(w, "invalid_grant", "unknown or expired code")
+		return
+	case auth.ClientID != clientID || auth.RedirectURI != r.PostForm.Get("redirect_uri"):
+		oauthError(w, "invalid_grant", "client_id or redirect_uri mismatch")
+		return
+	case pkceChallenge(r.PostForm.Get("code_verifier")) != auth.Challenge:
+		oauthError(w, "invalid_grant", "code_verifier does not match code_challenge")
+		return
+	}
+
+	now := time.Now()
+	idToken, err := p.sign(map[string]any{
+		"iss":            p.issuer,
+		"sub":            subject(auth.Email),
+		"aud":            clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(idTokenTTL).Unix(),
+		"auth_time":      auth.AuthTime.Unix(),
+		"nonce":          auth.Nonce,
+		"email":          auth.Email,
+		"email_verified": auth.EmailVerified,
+		"name":           auth.Name,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(16),
+		"token_type":   "Bearer",
+		"expires_in":   int(idTokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// sign собирает JWT с подписью EdDSA; библиотека для этого не нужна.
+func (p *provider) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": p.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(p.key, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// subject — стабильный идентификатор пользователя, как у настоящих провайдеров
+// он не совпадает с email.
+func subject(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(sum[:12])
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func oauthError(w http.ResponseWriter, code, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
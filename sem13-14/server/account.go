@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Токены из писем подписываются отдельным секретом и привязаны к состоянию
+// аккаунта через claim "fp": для подтверждения — к адресу, для сброса — к текущему
+// хэшу пароля. После смены пароля ссылка на сброс перестаёт работать.
+const (
+	tokenTypeEmailVerify   = "email_verify"
+	tokenTypePasswordReset = "password_reset"
+
+	emailVerifyTTL   = 24 * time.Hour
+	passwordResetTTL = time.Hour
+)
+
+var errEmailTokenInvalid = errors.New("invalid or expired token")
+
+func fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+func signEmailToken(typ string, userID int, state string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ": typ,
+		"iss": cfg.JWTIssuer,
+		"sub": strconv.Itoa(userID),
+		"fp":  fingerprint(state),
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	}).SignedString([]byte(cfg.EmailTokenSecret))
+}
+
+// parseEmailToken возвращает пользователя из токена и отпечаток состояния,
+// который вызывающий сверяет с текущим.
+func parseEmailToken(tokenString, typ string) (int, string, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(cfg.EmailTokenSecret), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(cfg.JWTIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || claims["typ"] != typ {
+		return 0, "", errEmailTokenInvalid
+	}
+
+	sub, _ := claims["sub"].(string)
+	userID, err := strconv.Atoi(sub)
+	if err != nil {
+		return 0, "", errEmailTokenInvalid
+	}
+	fp, _ := claims["fp"].(string)
+	return userID, fp, nil
+}
+
+func appLink(param, token string) string {
+	return fmt.Sprintf("%s/?%s=%s", cfg.AppURL, param, url.QueryEscape(token))
+}
+
+func sendVerificationEmail(ctx context.Context, userID int, email string) error {
+	token, err := signEmailToken(tokenTypeEmailVerify, userID, email, emailVerifyTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(ctx, MailMessage{
+		To:      email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf("To confirm your email, open the link:\n\n%s\n\nThe link is valid for %s.\n",
+			appLink("verify_token", token), emailVerifyTTL),
+	})
+}
+
+func sendPasswordResetEmail(ctx context.Context, userID int, email, passwordHash string) error {
+	token, err := signEmailToken(tokenTypePasswordReset, userID, passwordHash, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(ctx, MailMessage{
+		To:      email,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("To set a new password, open the link:\n\n%s\n\nThe link is valid for %s. "+
+			"If you did not request a reset, ignore this email.\n",
+			appLink("reset_token", token), passwordResetTTL),
+	})
+}
+
+func verifyEmail(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	userID, fp, err := parseEmailToken(req.Token, tokenTypeEmailVerify)
+	if err != nil {
+		problem(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user, err := users.ByID(ctx, userID)
+	if errors.Is(err, auth.ErrUserNotFound) || (err == nil && fingerprint(user.Email) != fp) {
+		problem(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE users SET email_verified_at = NOW() WHERE id = $1 AND email_verified_at IS NULL",
+		userID,
+	)
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+// resendVerification и forgotPassword отвечают одинаково независимо от того,
+// есть ли такой пользователь, чтобы по ним нельзя было перебирать адреса.
+func resendVerification(c *gin.Context) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user, err := users.ByEmail(ctx, req.Email)
+	if err == nil && !user.EmailVerified() {
+		err = sendVerificationEmail(ctx, user.ID, user.Email)
+	}
+	if err != nil && !errors.Is(err, auth.ErrUserNotFound) {
+		log.Printf("resend verification failed: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the account exists and is not verified, an email has been sent"})
+}
+
+func forgotPassword(c *gin.Context) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user, err := users.ByEmail(ctx, req.Email)
+	if err == nil {
+		err = sendPasswordResetEmail(ctx, user.ID, user.Email, user.PasswordHash)
+	}
+	if err != nil && !errors.Is(err, auth.ErrUserNotFound) {
+		log.Printf("password reset email failed: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the account exists, a reset link has been sent"})
+}
+
+// resetPassword задаёт новый пароль и завершает все сессии пользователя.
+// Адрес при этом считается подтверждённым: письмо до пользователя дошло.
+func resetPassword(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	userID, fp, err := parseEmailToken(req.Token, tokenTypePasswordReset)
+	if err != nil {
+		problem(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user, err := users.ByID(ctx, userID)
+	if errors.Is(err, auth.ErrUserNotFound) {
+		problem(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+	if msg := auth.ValidatePassword(req.Password, user.Email, cfg.PasswordPolicy); msg != "" {
+		respondProblem(c, validationFailed(fieldErrors{"password": msg}))
+		return
+	}
+
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRowContext(ctx, "SELECT password_hash FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && fingerprint(current) != fp) {
+		problem(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE users SET password_hash = $1, email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = $2",
+		hash, userID,
+	)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+			userID,
+		)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password updated"})
+}
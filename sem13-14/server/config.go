@@ -1,28 +1,191 @@
 package main
 
 import (
+	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth"
+	"shared/sqldb"
 )
 
 type Config struct {
-	DBHost     string
-	DBPort     string
-	DBUser     string
-	DBPassword string
-	DBName     string
-	JWTSecret  string
+	// production скрывает от клиентов текст внутренних ошибок, development показывает его в detail
+	Environment string
+
+	// Адрес базы, пул соединений и таймаут запросов
+	DB sqldb.Config
+
+	// Access-токены подписываются асимметричным ключом (EdDSA или RS256), который
+	// меняется раз в JWTKeyRotation; открытые ключи публикуются в JWKS.
+	// Refresh-токены проверяет только этот сервис, для них — отдельный секрет.
+	JWTSigningAlg    string
+	JWTKeyRotation   time.Duration
+	JWTRefreshSecret string
+	JWTIssuer        string
+	// Аудитория access-токенов — сервисы, которые их принимают
+	JWTAudience string
+
+	// Пользователи с этими адресами получают роль admin при регистрации
+	AdminEmails []string
+
+	// Политика паролей: минимальная длина и сколько классов символов
+	// (строчные, заглавные, цифры, прочие) должно встречаться
+	PasswordPolicy auth.PasswordPolicy
+
+	// Защита от перебора паролей: после стольких неудач подряд аккаунт или IP
+	// блокируется на LoginLockoutBase, каждая следующая неудача удваивает блокировку
+	LoginThrottleStore      string
+	LoginMaxAccountFailures int
+	LoginMaxIPFailures      int
+	LoginFailureWindow      time.Duration
+	LoginLockoutBase        time.Duration
+	LoginLockoutMax         time.Duration
+
+	// Лимиты частоты запросов, "<запросов>/<период>" или "off": публичные
+	// маршруты входа и восстановления доступа отдельно от API под /auth.
+	// RateLimitStore — memory для одной реплики или postgres для нескольких
+	RateLimitStore string
+	RateLimitAuth  RateLimit
+	RateLimitAPI   RateLimit
+	// Адреса nginx (IP или подсети), которым доверяется X-Forwarded-For
+	TrustedProxies []string
+
+	// Имя сервиса в приложении-аутентификаторе
+	TOTPIssuer string
+
+	// Вход через SSO по OpenID Connect; выключен, пока не задан OIDCIssuer.
+	// OIDCInternalURL — адрес провайдера изнутри сети контейнеров, если он
+	// отличается от адреса, который видит браузер
+	OIDCIssuer       string
+	OIDCInternalURL  string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       string
+
+	// body — токены в теле ответа, cookie — в HttpOnly-куках с защитой от CSRF
+	AuthTokenMode string
+	CookieSecure  bool
+	// Origin, которым разрешены запросы с куками и изменяющие запросы
+	CORSAllowedOrigins []string
+
+	// Сколько аккаунт ждёт удаления, пока его можно восстановить
+	AccountDeletionGrace time.Duration
+	// Насколько давним может быть вход через SSO, чтобы пользователь без пароля
+	// мог сменить email или пароль, удалить аккаунт или выключить 2FA
+	ReauthMaxAge time.Duration
+
+	// Адрес фронтенда для ссылок в письмах
+	AppURL string
+	// Секрет для токенов подтверждения почты и сброса пароля
+	EmailTokenSecret string
+
+	MailFrom     string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUser     string
+	SMTPPassword string
+	// Куда складываются письма, если SMTP не настроен
+	MailOutboxDir string
 }
 
-func LoadConfig() *Config {
+func LoadConfig() (*Config, error) {
 	cfg := &Config{
-		DBHost:     getEnv("DB_HOST", "db"),
-		DBPort:     getEnv("DB_PORT", "5432"),
-		DBUser:     getEnv("DB_USER", "postgres"),
-		DBPassword: getEnv("DB_PASSWORD", "12345678"),
-		DBName:     getEnv("DB_NAME", "db"),
-		JWTSecret:  getEnv("JWT_SECRET", "secret-key"),
+		Environment: getEnv("APP_ENV", "production"),
+
+		DB: sqldb.FromEnv(),
+
+		JWTSigningAlg:    getEnv("JWT_SIGNING_ALG", "EdDSA"),
+		JWTKeyRotation:   getEnvDuration("JWT_KEY_ROTATION", 7*24*time.Hour),
+		JWTRefreshSecret: getEnv("JWT_REFRESH_SECRET", ""),
+		JWTIssuer:        getEnv("JWT_ISSUER", "auth-service"),
+		JWTAudience:      getEnv("JWT_AUDIENCE", "front2sem"),
+
+		AdminEmails: getEnvList("ADMIN_EMAILS"),
+
+		PasswordPolicy: auth.PasswordPolicy{
+			MinLength:  getEnvInt("PASSWORD_MIN_LENGTH", 8),
+			MinClasses: getEnvInt("PASSWORD_MIN_CLASSES", 2),
+		},
+
+		LoginThrottleStore:      getEnv("LOGIN_THROTTLE_STORE", "memory"),
+		LoginMaxAccountFailures: getEnvInt("LOGIN_MAX_ACCOUNT_FAILURES", 5),
+		LoginMaxIPFailures:      getEnvInt("LOGIN_MAX_IP_FAILURES", 20),
+		LoginFailureWindow:      getEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LoginLockoutBase:        getEnvDuration("LOGIN_LOCKOUT_BASE", 30*time.Second),
+		LoginLockoutMax:         getEnvDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+
+		RateLimitStore: getEnv("RATE_LIMIT_STORE", "memory"),
+		RateLimitAuth:  getEnvRateLimit("RATE_LIMIT_AUTH", RateLimit{Burst: 20, Period: time.Minute}),
+		RateLimitAPI:   getEnvRateLimit("RATE_LIMIT_API", RateLimit{Burst: 120, Period: time.Minute}),
+
+		TOTPIssuer: getEnv("TOTP_ISSUER", "front2sem"),
+
+		AccountDeletionGrace: getEnvDuration("ACCOUNT_DELETION_GRACE", 30*24*time.Hour),
+		ReauthMaxAge:         getEnvDuration("REAUTH_MAX_AGE", 10*time.Minute),
+
+		AppURL:           strings.TrimSuffix(getEnv("APP_URL", "http://localhost"), "/"),
+		EmailTokenSecret: getEnv("EMAIL_TOKEN_SECRET", ""),
+
+		OIDCIssuer:       strings.TrimSuffix(getEnv("OIDC_ISSUER", ""), "/"),
+		OIDCInternalURL:  strings.TrimSuffix(getEnv("OIDC_INTERNAL_URL", ""), "/"),
+		OIDCClientID:     getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCScopes:       getEnv("OIDC_SCOPES", "openid email profile"),
+
+		MailFrom:      getEnv("MAIL_FROM", "no-reply@localhost"),
+		SMTPHost:      getEnv("SMTP_HOST", ""),
+		SMTPPort:      getEnv("SMTP_PORT", "25"),
+		SMTPUser:      getEnv("SMTP_USER", ""),
+		SMTPPassword:  getEnv("SMTP_PASSWORD", ""),
+		MailOutboxDir: getEnv("MAIL_OUTBOX_DIR", "/outbox"),
+	}
+	cfg.OIDCRedirectURL = getEnv("OIDC_REDIRECT_URL", cfg.AppURL+"/api/oidc/callback")
+	cfg.AuthTokenMode = getEnv("AUTH_TOKEN_MODE", tokenModeBody)
+	cfg.CookieSecure = getEnvBool("COOKIE_SECURE", strings.HasPrefix(cfg.AppURL, "https://"))
+	cfg.TrustedProxies = getEnvList("TRUSTED_PROXIES")
+	if len(cfg.TrustedProxies) == 0 {
+		cfg.TrustedProxies = []string{"127.0.0.1", "::1"}
 	}
-	return cfg
+	cfg.CORSAllowedOrigins = getEnvList("CORS_ALLOWED_ORIGINS")
+	if len(cfg.CORSAllowedOrigins) == 0 {
+		cfg.CORSAllowedOrigins = []string{cfg.AppURL}
+	}
+	if err := cfg.requireSecrets(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// requireSecrets не даёт запустить production с секретами по умолчанию: они
+// видны в репозитории, и с ними можно подделать refresh-токены, ссылки из писем
+// и state входа через SSO. В development подставляются заглушки.
+func (c *Config) requireSecrets() error {
+	secrets := []struct {
+		env   string
+		value *string
+	}{
+		{"JWT_REFRESH_SECRET", &c.JWTRefreshSecret},
+		{"EMAIL_TOKEN_SECRET", &c.EmailTokenSecret},
+	}
+	for _, secret := range secrets {
+		if *secret.value != "" {
+			continue
+		}
+		if c.Production() {
+			return fmt.Errorf("%s must be set unless APP_ENV=development", secret.env)
+		}
+		*secret.value = "development-" + strings.ToLower(secret.env)
+	}
+	return nil
+}
+
+func (c *Config) Production() bool {
+	return c.Environment != "development"
 }
 
 func getEnv(key, defaultValue string) string {
@@ -31,3 +194,54 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvRateLimit останавливает запуск на некорректном значении: опечатка в
+// лимите не должна молча превращаться в значение по умолчанию.
+func getEnvRateLimit(key string, defaultValue RateLimit) RateLimit {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	return limit
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// В режиме AUTH_TOKEN_MODE=cookie токены не отдаются в теле ответа, а ставятся
+// HttpOnly-куками: скрипт на странице до них не дотянется. Куки браузер
+// отправляет сам, поэтому изменяющие запросы защищены double-submit CSRF-токеном
+// и проверкой Origin.
+const (
+	tokenModeBody   = "body"
+	tokenModeCookie = "cookie"
+
+	accessTokenCookie  = "access_token"
+	refreshTokenCookie = "refresh_token"
+	// CSRF-кука читается скриптом и возвращается в заголовке X-CSRF-Token;
+	// чужой сайт прочитать её не может
+	csrfCookie = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+func cookieMode() bool {
+	return cfg.AuthTokenMode == tokenModeCookie
+}
+
+func setCookie(c *gin.Context, name, value string, maxAge int, httpOnly bool) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, value, maxAge, "/", "", cfg.CookieSecure, httpOnly)
+}
+
+func setAuthCookies(c *gin.Context, access, refresh string) {
+	setCookie(c, accessTokenCookie, access, int(accessTokenTTL.Seconds()), true)
+	setCookie(c, refreshTokenCookie, refresh, int(refreshTokenTTL.Seconds()), true)
+	setCookie(c, csrfCookie, newTokenID(), int(refreshTokenTTL.Seconds()), false)
+}
+
+func clearAuthCookies(c *gin.Context) {
+	for _, name := range []string{accessTokenCookie, refreshTokenCookie, csrfCookie} {
+		setCookie(c, name, "", -1, name != csrfCookie)
+	}
+}
+
+// respondWithTokens отдаёт новую пару токенов так, как настроен сервис.
+func respondWithTokens(c *gin.Context, access, refresh string) {
+	if cookieMode() {
+		setAuthCookies(c, access, refresh)
+		c.JSON(http.StatusOK, gin.H{"message": "Logged in"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  access,
+		"refresh_token": refresh,
+	})
+}
+
+// requestRefreshToken берёт refresh-токен из тела запроса, а в режиме кук — из куки.
+func requestRefreshToken(c *gin.Context, fromBody string) string {
+	if fromBody == "" && cookieMode() {
+		fromBody, _ = c.Cookie(refreshTokenCookie)
+	}
+	return fromBody
+}
+
+func originAllowed(origin string) bool {
+	return slices.Contains(cfg.CORSAllowedOrigins, origin)
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// csrfMiddleware пропускает изменяющие запросы только с разрешённым Origin, а
+// запросы, которые несут куки с токенами, — только с совпадающим CSRF-токеном.
+// Запросы с заголовком Authorization браузер сам не подставляет, им CSRF не страшен.
+func csrfMiddleware(c *gin.Context) {
+	if safeMethod(c.Request.Method) {
+		c.Next()
+		return
+	}
+
+	if origin := c.GetHeader("Origin"); origin != "" && !originAllowed(origin) {
+		problem(c, http.StatusForbidden, "origin_not_allowed", "Origin not allowed")
+		return
+	}
+
+	_, errAccess := c.Cookie(accessTokenCookie)
+	_, errRefresh := c.Cookie(refreshTokenCookie)
+	if errAccess != nil && errRefresh != nil {
+		c.Next()
+		return
+	}
+
+	expected, _ := c.Cookie(csrfCookie)
+	actual := c.GetHeader(csrfHeader)
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+		problem(c, http.StatusForbidden, "invalid_csrf_token", "Invalid CSRF token")
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,8 @@
+package main
+
+import "context"
+
+// queryContext ограничивает время запросов к БД в рамках одного HTTP-запроса.
+func queryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return cfg.DB.QueryContext(parent)
+}
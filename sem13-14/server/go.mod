@@ -3,11 +3,12 @@ module server
 go 1.23.5
 
 require (
+	auth v0.0.0
+	shared v0.0.0
 	github.com/gin-contrib/cors v1.7.4
 	github.com/gin-gonic/gin v1.10.0
 	github.com/golang-jwt/jwt/v5 v5.2.2
 	github.com/lib/pq v1.10.9
-	golang.org/x/crypto v0.36.0
 )
 
 require (
@@ -32,9 +33,16 @@ require (
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/ugorji/go/codec v1.2.12 // indirect
 	golang.org/x/arch v0.12.0 // indirect
+	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/net v0.37.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
 	google.golang.org/protobuf v1.36.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+// Общие пакеты сервисов лежат в корне репозитория
+replace (
+	auth => ../../auth
+	shared => ../../shared
+)
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ключи подписи access-токенов хранятся в таблице signing_keys, чтобы переживать
+// перезапуск и быть общими для нескольких реплик. Новыми токенами подписывает
+// самый свежий ключ; выведенные из оборота ключи ещё какое-то время публикуются
+// в JWKS, пока не истекут подписанные ими токены.
+
+// Как часто реплика перечитывает ключи и проверяет, не пора ли их ротировать.
+const keyReloadInterval = 5 * time.Minute
+
+// Ключ advisory-блокировки, чтобы ротацию выполняла одна реплика.
+const keyRotationLockID = 1401
+
+var errNoSigningKey = errors.New("no active signing key")
+
+type jwtKey struct {
+	ID        string
+	Alg       string
+	Private   crypto.Signer
+	CreatedAt time.Time
+}
+
+type keyStore struct {
+	mu   sync.RWMutex
+	keys []*jwtKey // новые первыми
+}
+
+var signingKeys = &keyStore{}
+
+// current возвращает ключ для подписи новых токенов.
+func (s *keyStore) current() *jwtKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.keys) == 0 {
+		return nil
+	}
+	return s.keys[0]
+}
+
+func (s *keyStore) lookup(kid string) *jwtKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+func (s *keyStore) all() []*jwtKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys
+}
+
+// keyRetention — сколько выведенный ключ остаётся в JWKS: другие реплики могут
+// подписывать им до следующей перезагрузки ключей, а токены живут accessTokenTTL.
+func keyRetention() time.Duration {
+	return keyReloadInterval + accessTokenTTL
+}
+
+func (s *keyStore) load(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `
+        SELECT kid, alg, private_key, created_at FROM signing_keys
+        WHERE retired_at IS NULL OR retired_at > NOW() - $1 * INTERVAL '1 second'
+        ORDER BY created_at DESC`,
+		keyRetention().Seconds(),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var keys []*jwtKey
+	for rows.Next() {
+		var (
+			key     jwtKey
+			encoded string
+		)
+		if err := rows.Scan(&key.ID, &key.Alg, &encoded, &key.CreatedAt); err != nil {
+			return err
+		}
+		if key.Private, err = decodePrivateKey(encoded); err != nil {
+			return fmt.Errorf("signing key %s: %w", key.ID, err)
+		}
+		keys = append(keys, &key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+func generatePrivateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "EdDSA":
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+}
+
+func encodePrivateKey(key crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+func decodePrivateKey(encoded string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported key type")
+	}
+	return signer, nil
+}
+
+// rotateSigningKeys создаёт новый ключ, если активного нет или он старше
+// JWTKeyRotation, и выводит из оборота предыдущие. Ключи, которые больше
+// не нужны для проверки, удаляются.
+func rotateSigningKeys(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", keyRotationLockID); err != nil {
+		return err
+	}
+
+	var newest sql.NullTime
+	err = tx.QueryRowContext(ctx, "SELECT MAX(created_at) FROM signing_keys WHERE retired_at IS NULL").Scan(&newest)
+	if err != nil {
+		return err
+	}
+
+	if !newest.Valid || time.Since(newest.Time) >= cfg.JWTKeyRotation {
+		private, err := generatePrivateKey(cfg.JWTSigningAlg)
+		if err != nil {
+			return err
+		}
+		encoded, err := encodePrivateKey(private)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE signing_keys SET retired_at = NOW() WHERE retired_at IS NULL"); err != nil {
+			return err
+		}
+		kid := newTokenID()
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO signing_keys (kid, alg, private_key) VALUES ($1, $2, $3)",
+			kid, cfg.JWTSigningAlg, encoded,
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("signing key rotated: new kid %s (%s)", kid, cfg.JWTSigningAlg)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM signing_keys WHERE retired_at < NOW() - $1 * INTERVAL '1 second'",
+		keyRetention().Seconds(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return signingKeys.load(ctx)
+}
+
+func runKeyRotation() {
+	ticker := time.NewTicker(keyReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DB.QueryTimeout)
+		if err := rotateSigningKeys(ctx); err != nil {
+			log.Printf("signing key rotation failed: %v", err)
+		}
+		cancel()
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func publicJWK(key *jwtKey) (jwk, error) {
+	result := jwk{Kid: key.ID, Alg: key.Alg, Use: "sig"}
+	switch public := key.Private.Public().(type) {
+	case ed25519.PublicKey:
+		result.Kty, result.Crv = "OKP", "Ed25519"
+		result.X = base64.RawURLEncoding.EncodeToString(public)
+	case *rsa.PublicKey:
+		result.Kty = "RSA"
+		result.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		result.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	default:
+		return jwk{}, fmt.Errorf("unsupported public key %T", public)
+	}
+	return result, nil
+}
+
+// jwks публикует открытые ключи, которыми сервисы проверяют access-токены.
+func jwks(c *gin.Context) {
+	keys := []jwk{}
+	for _, key := range signingKeys.all() {
+		k, err := publicJWK(key)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		keys = append(keys, k)
+	}
+
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(keyReloadInterval.Seconds())))
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer отправляет письма пользователям. Без SMTP_HOST письма складываются
+// в каталог MAIL_OUTBOX_DIR, чтобы проверять сценарии без почтового сервера.
+type Mailer interface {
+	Send(ctx context.Context, msg MailMessage) error
+}
+
+var mailer Mailer
+
+func newMailer(cfg *Config) (Mailer, error) {
+	if cfg.SMTPHost != "" {
+		return &smtpMailer{cfg: cfg}, nil
+	}
+	if err := os.MkdirAll(cfg.MailOutboxDir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileOutbox{dir: cfg.MailOutboxDir, from: cfg.MailFrom}, nil
+}
+
+func formatMessage(from string, msg MailMessage) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// fileOutbox пишет каждое письмо в отдельный .eml-файл.
+type fileOutbox struct {
+	dir  string
+	from string
+}
+
+func (o *fileOutbox) Send(_ context.Context, msg MailMessage) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), newTokenID()[:8])
+	return os.WriteFile(filepath.Join(o.dir, name), formatMessage(o.from, msg), 0o644)
+}
+
+type smtpMailer struct {
+	cfg *Config
+}
+
+func (m *smtpMailer) Send(_ context.Context, msg MailMessage) error {
+	var auth smtp.Auth
+	if m.cfg.SMTPUser != "" {
+		auth = smtp.PlainAuth("", m.cfg.SMTPUser, m.cfg.SMTPPassword, m.cfg.SMTPHost)
+	}
+	addr := fmt.Sprintf("%s:%s", m.cfg.SMTPHost, m.cfg.SMTPPort)
+	return smtp.SendMail(addr, auth, m.cfg.MailFrom, []string{msg.To}, formatMessage(m.cfg.MailFrom, msg))
+}
@@ -1,109 +1,226 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"auth"
+	"auth/totp"
+	"shared/sqldb"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	_ "github.com/lib/pq"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var db *sql.DB
 var cfg *Config
+var users *auth.Store
 
 func main() {
-	cfg = LoadConfig()
-
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName,
-	)
-
 	var err error
-	db, err = sql.Open("postgres", connStr)
+	cfg, err = LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.AuthTokenMode != tokenModeBody && cfg.AuthTokenMode != tokenModeCookie {
+		log.Fatalf("unknown AUTH_TOKEN_MODE %q", cfg.AuthTokenMode)
+	}
+
+	db, err = sqldb.Open(cfg.DB)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
+	// Таблица users общая с sem15-16, её схему ведёт пакет auth
+	users = auth.NewStore(db)
+	if _, err := db.Exec(auth.Schema); err != nil {
+		log.Fatal(err)
+	}
+
 	if _, err := db.Exec(`
-        CREATE TABLE IF NOT EXISTS users (
-            id SERIAL PRIMARY KEY,
-            email TEXT UNIQUE NOT NULL,
-            password TEXT NOT NULL,
-            created_at TIMESTAMP DEFAULT NOW()
+        ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name TEXT;
+        ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_url TEXT;
+        -- Новый адрес, ожидающий подтверждения по ссылке из письма
+        ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email TEXT;
+        -- Аккаунт удаляется через ACCOUNT_DELETION_GRACE после этого момента
+        ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_requested_at TIMESTAMPTZ;
+
+        CREATE TABLE IF NOT EXISTS refresh_tokens (
+            id TEXT PRIMARY KEY,
+            user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            family_id TEXT NOT NULL,
+            expires_at TIMESTAMPTZ NOT NULL,
+            used_at TIMESTAMPTZ,
+            revoked_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens(family_id);
+        CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx ON refresh_tokens(user_id);
+
+        CREATE TABLE IF NOT EXISTS signing_keys (
+            kid TEXT PRIMARY KEY,
+            alg TEXT NOT NULL,
+            private_key TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            retired_at TIMESTAMPTZ
+        );
+
+        -- Внешние учётные записи SSO: пользователь провайдера определяется парой issuer + sub
+        CREATE TABLE IF NOT EXISTS user_identities (
+            issuer TEXT NOT NULL,
+            subject TEXT NOT NULL,
+            user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            email TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            last_login_at TIMESTAMPTZ,
+            PRIMARY KEY (issuer, subject)
+        );
+        CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities(user_id);
+
+        CREATE TABLE IF NOT EXISTS login_throttle (
+            key TEXT PRIMARY KEY,
+            failures INT NOT NULL,
+            last_failure TIMESTAMPTZ NOT NULL,
+            locked_until TIMESTAMPTZ
+        );
+
+        CREATE TABLE IF NOT EXISTS rate_limits (
+            key TEXT PRIMARY KEY,
+            tat TIMESTAMPTZ NOT NULL
         )`); err != nil {
 		log.Fatal(err)
 	}
 
-	router := gin.Default()
+	twoFactor = totp.NewStore(db)
+	if _, err := db.Exec(totp.Schema); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := rotateSigningKeys(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	mailer, err = newMailer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	throttle, err = newLoginThrottle(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rateLimits, err = newRateStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sso = newOIDCProvider(cfg)
+	go runKeyRotation()
+	go runAccountPurge()
+
+	router := gin.New()
+	router.Use(gin.Logger(), gin.CustomRecovery(recoverProblem))
+	router.NoRoute(func(c *gin.Context) {
+		problem(c, http.StatusNotFound, "not_found", "Route not found")
+	})
+	// X-Forwarded-For читается справа налево до первого адреса не из TRUSTED_PROXIES,
+	// поэтому подставленные клиентом значения не учитываются
+	router.RemoteIPHeaders = []string{"X-Forwarded-For"}
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
 
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		AllowOrigins:     cfg.CORSAllowedOrigins,
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", csrfHeader},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 	}))
-
-	router.POST("/register", register)
-	router.POST("/login", login)
-	router.POST("/refresh", refreshToken)
-
-	auth := router.Group("/auth")
-	auth.Use(authMiddleware)
-	auth.GET("/me", getProfile)
-	auth.GET("/protected", protected)
+	router.Use(csrfMiddleware)
+
+	router.GET("/.well-known/jwks.json", jwks)
+	public := router.Group("/", rateLimit("auth", cfg.RateLimitAuth))
+	public.POST("/register", register)
+	public.POST("/login", login)
+	public.POST("/login/2fa", loginTwoFactor)
+	public.GET("/oidc/login", oidcLogin)
+	public.GET("/oidc/callback", oidcCallback)
+	public.POST("/refresh", refreshToken)
+	public.POST("/logout", logout)
+	public.POST("/verify-email", verifyEmail)
+	public.POST("/resend-verification", resendVerification)
+	public.POST("/forgot-password", forgotPassword)
+	public.POST("/reset-password", resetPassword)
+	public.POST("/confirm-email-change", confirmEmailChange)
+
+	authorized := router.Group("/auth")
+	authorized.Use(authMiddleware, rateLimit("api", cfg.RateLimitAPI))
+	authorized.GET("/me", getProfile)
+	authorized.PATCH("/me", updateProfile)
+	authorized.DELETE("/me", deleteAccount)
+	authorized.POST("/me/email", changeEmail)
+	authorized.POST("/me/password", changePassword)
+	authorized.POST("/me/cancel-deletion", cancelAccountDeletion)
+	authorized.GET("/protected", protected)
+	authorized.POST("/logout-all", logoutAll)
+	authorized.PUT("/users/:id/role", requireRole(roleAdmin), setUserRole)
+	authorized.GET("/2fa", twoFactorStatus)
+	authorized.POST("/2fa/setup", setupTwoFactor)
+	authorized.POST("/2fa/enable", enableTwoFactor)
+	authorized.POST("/2fa/disable", disableTwoFactor)
+	authorized.POST("/2fa/recovery-codes", regenerateRecoveryCodes)
 
 	router.Run(":8080")
 }
 
 func authMiddleware(c *gin.Context) {
 	authHeader := c.GetHeader("Authorization")
+	cookieToken, _ := c.Cookie(accessTokenCookie)
+	if authHeader == "" && cookieMode() && cookieToken != "" {
+		authHeader = "Bearer " + cookieToken
+	}
 	if authHeader == "" {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
+		problem(c, http.StatusUnauthorized, "unauthorized", "Authorization header is required")
 		return
 	}
 
 	parts := strings.Split(authHeader, " ")
 	if len(parts) != 2 {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header format"})
+		problem(c, http.StatusUnauthorized, "unauthorized", "Invalid authorization header format")
 		return
 	}
 
 	if parts[0] != "Bearer" {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization scheme not supported"})
+		problem(c, http.StatusUnauthorized, "unauthorized", "Authorization scheme not supported")
 		return
 	}
 
-	tokenString := parts[1]
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-		}
-		return []byte(cfg.JWTSecret), nil
-	})
-
-	if err != nil || !token.Valid {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+	userID, claims, err := parseToken(parts[1], tokenTypeAccess)
+	if err != nil {
+		problem(c, http.StatusUnauthorized, "invalid_token", "Invalid token")
 		return
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+	role, _ := claims["role"].(string)
+	if !validRole(role) {
+		problem(c, http.StatusUnauthorized, "invalid_token", "Invalid token claims")
 		return
 	}
 
-	c.Set("accessToken", tokenString)
-	c.Set("userID", claims["sub"])
+	c.Set("userID", userID)
+	c.Set("role", role)
+	c.Set("authTime", claimAuthTime(claims))
 	c.Next()
 }
 
@@ -114,35 +231,48 @@ func register(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
 		return
 	}
 
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)", req.Email).Scan(&exists)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		return
+	req.Email = normalizeEmail(req.Email)
+	errs := fieldErrors{}
+	if msg := validateEmail(req.Email); msg != "" {
+		errs["email"] = msg
 	}
-
-	if exists {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User exists"})
+	if msg := auth.ValidatePassword(req.Password, req.Email, cfg.PasswordPolicy); msg != "" {
+		errs["password"] = msg
+	}
+	if len(errs) > 0 {
+		respondProblem(c, validationFailed(errs))
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	hash, err := auth.HashPassword(req.Password)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		internalError(c, err)
 		return
 	}
 
-	_, err = db.Exec("INSERT INTO users (email, password) VALUES ($1, $2)", req.Email, string(hash))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+	user := &auth.User{Email: req.Email, PasswordHash: hash, Role: roleForNewUser(req.Email)}
+	if err := users.Create(ctx, user); err != nil {
+		if errors.Is(err, auth.ErrUserExists) {
+			problem(c, http.StatusConflict, "user_exists", "User exists")
+			return
+		}
+		internalError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User created"})
+	// Пользователь уже создан; если письмо не ушло, его можно запросить повторно
+	if err := sendVerificationEmail(ctx, user.ID, req.Email); err != nil {
+		log.Printf("verification email for user %d failed: %v", user.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User created, check your email to confirm the address"})
 }
 
 func login(c *gin.Context) {
@@ -152,130 +282,158 @@ func login(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
 		return
 	}
 
-	var user struct {
-		ID       int
-		Email    string
-		Password string
-	}
+	req.Email = normalizeEmail(req.Email)
+	ip := c.ClientIP()
 
-	err := db.QueryRow(
-		"SELECT id, email, password FROM users WHERE email = $1",
-		req.Email,
-	).Scan(&user.ID, &user.Email, &user.Password)
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
 
+	wait, err := throttle.Check(ctx, req.Email, ip)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		internalError(c, err)
 		return
 	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	if wait > 0 {
+		tooManyAttempts(ctx, c, req.Email, ip, wait)
 		return
 	}
 
-	accessToken, refreshToken, err := generateTokens(user.ID)
+	user, err := users.ByEmail(ctx, req.Email)
+	if errors.Is(err, auth.ErrUserNotFound) {
+		loginFailed(ctx, c, req.Email, ip, "unknown_user")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token error"})
+		dbError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
-	})
-}
-
-func generateTokens(userID int) (string, string, error) {
-	access := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": userID,
-		"exp": time.Now().Add(15 * time.Minute).Unix(),
-	})
-
-	refresh := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": userID,
-		"exp": time.Now().Add(168 * time.Hour).Unix(),
-	})
-
-	accessSigned, _ := access.SignedString([]byte(cfg.JWTSecret))
-	refreshSigned, _ := refresh.SignedString([]byte(cfg.JWTSecret))
-
-	return accessSigned, refreshSigned, nil
-}
-
-func refreshToken(c *gin.Context) {
-	var req struct {
-		RefreshToken string `json:"refresh_token"`
+	if !auth.CheckPassword(user.PasswordHash, req.Password) {
+		loginFailed(ctx, c, req.Email, ip, "bad_password")
+		return
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+	if !user.EmailVerified() {
+		if err := throttle.Succeed(ctx, req.Email); err != nil {
+			log.Printf("failed to reset login throttle: %v", err)
+		}
+		problem(c, http.StatusForbidden, "email_not_verified", "Email not verified")
 		return
 	}
 
-	token, err := jwt.Parse(req.RefreshToken, func(t *jwt.Token) (interface{}, error) {
-		return []byte(cfg.JWTSecret), nil
-	})
-
-	if err != nil || !token.Valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+	enabled, _, err := twoFactor.Status(ctx, user.ID)
+	if err != nil {
+		dbError(c, err)
 		return
 	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+	// Счётчик неудач сбрасывается только после второго фактора,
+	// иначе знание пароля давало бы неограниченный перебор кодов
+	if enabled {
+		mfaToken, err := signMFAToken(user.ID, time.Now())
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": mfaToken})
 		return
 	}
 
-	userID := int(claims["sub"].(float64))
-	access, refresh, err := generateTokens(userID)
+	if err := throttle.Succeed(ctx, req.Email); err != nil {
+		log.Printf("failed to reset login throttle: %v", err)
+	}
+	completeLogin(ctx, c, user.ID, user.Role, time.Now())
+}
+
+// startSession выдаёт пару токенов новой сессии после всех проверок входа.
+// authTime — когда пользователь ввёл пароль или вошёл у провайдера SSO.
+func startSession(ctx context.Context, userID int, role string, authTime time.Time) (string, string, error) {
+	// Истёкшие токены для обнаружения повторного использования уже не нужны
+	if _, err := db.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE user_id = $1 AND expires_at < NOW()", userID); err != nil {
+		return "", "", err
+	}
+	return issueTokens(ctx, db, userID, role, newTokenID(), authTime)
+}
+
+func completeLogin(ctx context.Context, c *gin.Context, userID int, role string, authTime time.Time) {
+	accessToken, refreshToken, err := startSession(ctx, userID, role, authTime)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token error"})
+		internalError(c, err)
 		return
 	}
+	respondWithTokens(c, accessToken, refreshToken)
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token":  access,
-		"refresh_token": refresh,
-	})
+func tooManyAttempts(ctx context.Context, c *gin.Context, email, ip string, wait time.Duration) {
+	users.RecordLoginFailure(ctx, email, ip, "locked")
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	problem(c, http.StatusTooManyRequests, "login_throttled", "Too many login attempts, try again later")
+}
+
+// loginFailed учитывает неудачную попытку и отвечает одинаково для
+// неизвестного пользователя и неверного пароля.
+func loginFailed(ctx context.Context, c *gin.Context, email, ip, reason string) {
+	users.RecordLoginFailure(ctx, email, ip, reason)
+	if err := throttle.Fail(ctx, email, ip); err != nil {
+		log.Printf("failed to update login throttle: %v", err)
+	}
+	problem(c, http.StatusUnauthorized, "invalid_credentials", "Invalid credentials")
 }
 
 func getProfile(c *gin.Context) {
-	userID, _ := c.Get("userID")
-	id := int(userID.(float64))
+	id := c.GetInt("userID")
 
 	var user struct {
-		Email     string    `json:"email"`
-		CreatedAt time.Time `json:"created_at"`
+		Email               string
+		Role                string
+		DisplayName         sql.NullString
+		AvatarURL           sql.NullString
+		PendingEmail        sql.NullString
+		DeletionRequestedAt sql.NullTime
+		CreatedAt           time.Time
 	}
 
-	err := db.QueryRow(
-		"SELECT email, created_at FROM users WHERE id = $1",
-		id,
-	).Scan(&user.Email, &user.CreatedAt)
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
 
+	err := db.QueryRowContext(ctx,
+		"SELECT COALESCE(email, ''), role, display_name, avatar_url, pending_email, deletion_requested_at, created_at FROM users WHERE id = $1",
+		id,
+	).Scan(&user.Email, &user.Role, &user.DisplayName, &user.AvatarURL, &user.PendingEmail, &user.DeletionRequestedAt, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem(c, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		dbError(c, err)
 		return
 	}
 
+	var deletionScheduledAt *time.Time
+	if user.DeletionRequestedAt.Valid {
+		t := user.DeletionRequestedAt.Time.Add(cfg.AccountDeletionGrace)
+		deletionScheduledAt = &t
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"id":         id,
-		"email":      user.Email,
-		"created_at": user.CreatedAt,
+		"id":                    id,
+		"email":                 user.Email,
+		"role":                  user.Role,
+		"display_name":          user.DisplayName.String,
+		"avatar_url":            user.AvatarURL.String,
+		"pending_email":         user.PendingEmail.String,
+		"deletion_scheduled_at": deletionScheduledAt,
+		"created_at":            user.CreatedAt,
 	})
 }
 
 func protected(c *gin.Context) {
-	userID, _ := c.Get("userID")
-	token, _ := c.Get("accessToken")
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Secret data",
-		"user_id": userID,
-		"token":   token,
+		"user_id": c.GetInt("userID"),
+		"role":    c.GetString("role"),
 	})
 }
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Вход через корпоративный SSO по OpenID Connect: authorization code + PKCE.
+// Внешняя учётная запись (issuer + sub) привязывается к строке users, дальше
+// выдаются обычные access/refresh-токены.
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+
+	// Незнакомый kid может означать ротацию ключей у провайдера, поэтому JWKS
+	// перечитывается, но не чаще этого интервала.
+	oidcJWKSMinRefetch = 30 * time.Second
+)
+
+var (
+	errOIDCDisabled      = errors.New("SSO is not configured")
+	errOIDCEmailRequired = errors.New("identity provider did not return a verified email")
+	errOIDCUnverified    = errors.New("local account email is not verified")
+)
+
+type oidcConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// oidcProvider читает discovery-документ и ключи провайдера при первом входе
+// и кэширует их.
+type oidcProvider struct {
+	issuer string
+	// internalURL заменяет issuer в адресах, к которым ходит сам сервер:
+	// браузер и бэкенд могут видеть провайдера по разным адресам
+	internalURL string
+	client      *http.Client
+
+	mu            sync.Mutex
+	config        *oidcConfiguration
+	keys          map[string]oidcKey
+	keysFetchedAt time.Time
+}
+
+var sso *oidcProvider
+
+func newOIDCProvider(cfg *Config) *oidcProvider {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	return &oidcProvider{
+		issuer:      cfg.OIDCIssuer,
+		internalURL: cfg.OIDCInternalURL,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *oidcProvider) internal(endpoint string) string {
+	if p.internalURL == "" {
+		return endpoint
+	}
+	if rest, ok := strings.CutPrefix(endpoint, p.issuer); ok {
+		return p.internalURL + rest
+	}
+	return endpoint
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, endpoint string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.internal(endpoint), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *oidcProvider) discover(ctx context.Context) (*oidcConfiguration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil {
+		return p.config, nil
+	}
+	var config oidcConfiguration
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return nil, err
+	}
+	if config.Issuer != p.issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", config.Issuer, p.issuer)
+	}
+	p.config = &config
+	return p.config, nil
+}
+
+func (p *oidcProvider) key(ctx context.Context, config *oidcConfiguration, kid string) (oidcKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[kid]
+	if !ok && time.Since(p.keysFetchedAt) > oidcJWKSMinRefetch {
+		p.keysFetchedAt = time.Now()
+
+		var set struct {
+			Keys []struct {
+				Kty string `json:"kty"`
+				Kid string `json:"kid"`
+				Alg string `json:"alg"`
+				Use string `json:"use"`
+				Crv string `json:"crv"`
+				X   string `json:"x"`
+				N   string `json:"n"`
+				E   string `json:"e"`
+			} `json:"keys"`
+		}
+		if err := p.getJSON(ctx, config.JWKSURI, &set); err != nil {
+			return oidcKey{}, err
+		}
+
+		keys := map[string]oidcKey{}
+		for _, k := range set.Keys {
+			if k.Use != "" && k.Use != "sig" {
+				continue
+			}
+			switch {
+			case k.Kty == "OKP" && k.Crv == "Ed25519":
+				x, err := base64.RawURLEncoding.DecodeString(k.X)
+				if err != nil || len(x) != ed25519.PublicKeySize {
+					continue
+				}
+				keys[k.Kid] = oidcKey{alg: "EdDSA", key: ed25519.PublicKey(x)}
+			// Многие провайдеры не указывают alg у RSA-ключей, для ID-токенов это RS256
+			case k.Kty == "RSA" && (k.Alg == "" || k.Alg == "RS256"):
+				n, errN := base64.RawURLEncoding.DecodeString(k.N)
+				e, errE := base64.RawURLEncoding.DecodeString(k.E)
+				if errN != nil || errE != nil {
+					continue
+				}
+				keys[k.Kid] = oidcKey{alg: "RS256", key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}}
+			}
+		}
+		p.keys = keys
+		key, ok = keys[kid]
+	}
+	if !ok {
+		return oidcKey{}, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// exchange обменивает код авторизации на ID-токен, подтверждая PKCE-верификатором.
+func (p *oidcProvider) exchange(ctx context.Context, config *oidcConfiguration, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {cfg.OIDCRedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.internal(config.TokenEndpoint), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(cfg.OIDCClientID), url.QueryEscape(cfg.OIDCClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint: no id_token in response")
+	}
+	return body.IDToken, nil
+}
+
+type idTokenClaims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	// Когда пользователь последний раз вводил учётные данные у провайдера;
+	// нулевое, если провайдер не прислал auth_time
+	AuthTime time.Time
+}
+
+// verifyIDToken проверяет подпись ключом провайдера, издателя, аудиторию,
+// срок действия и nonce из начала входа.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, config *oidcConfiguration, raw, nonce string) (*idTokenClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := p.key(ctx, config, kid)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method.Alg() != key.alg {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return key.key, nil
+	},
+		jwt.WithValidMethods([]string{"EdDSA", "RS256"}),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(cfg.OIDCClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims["nonce"] != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("missing sub claim")
+	}
+	email, _ := claims["email"].(string)
+	verified, _ := claims["email_verified"].(bool)
+	return &idTokenClaims{
+		Subject:       sub,
+		Email:         normalizeEmail(email),
+		EmailVerified: verified,
+		AuthTime:      claimAuthTime(claims),
+	}, nil
+}
+
+// Состояние входа (state, nonce, PKCE-верификатор) живёт в подписанной HttpOnly-куке:
+// так ответ провайдера принимается только в том браузере, который начал вход.
+func signOIDCState(state, nonce, verifier string) (string, error) {
+	now := time.Now()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ":   "oidc_state",
+		"iss":   cfg.JWTIssuer,
+		"state": state,
+		"nonce": nonce,
+		"cv":    verifier,
+		"iat":   now.Unix(),
+		"exp":   now.Add(oidcStateTTL).Unix(),
+	}).SignedString([]byte(cfg.JWTRefreshSecret))
+}
+
+func parseOIDCState(tokenString string) (state, nonce, verifier string, err error) {
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(cfg.JWTRefreshSecret), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(cfg.JWTIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || claims["typ"] != "oidc_state" {
+		return "", "", "", errors.New("invalid login state")
+	}
+	state, _ = claims["state"].(string)
+	nonce, _ = claims["nonce"].(string)
+	verifier, _ = claims["cv"].(string)
+	return state, nonce, verifier, nil
+}
+
+func randomURLString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func setOIDCStateCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, "/", "", cfg.CookieSecure, true)
+}
+
+// redirectToApp возвращает браузер на фронтенд. Токены передаются во фрагменте
+// адреса: он не уходит на сервер и не попадает в логи nginx.
+func redirectToApp(c *gin.Context, params url.Values) {
+	c.Redirect(http.StatusFound, cfg.AppURL+"/#"+params.Encode())
+}
+
+func ssoFailed(c *gin.Context, message string) {
+	redirectToApp(c, url.Values{"sso_error": {message}})
+}
+
+// oidcLogin начинает вход: запоминает state, nonce и верификатор в куке
+// и отправляет браузер к провайдеру. С ?reauth=1 провайдер обязан заново
+// спросить учётные данные (prompt=login, max_age=0) — так пользователь без
+// пароля подтверждает опасные операции, см. checkCurrentPassword.
+func oidcLogin(c *gin.Context) {
+	if sso == nil {
+		ssoFailed(c, errOIDCDisabled.Error())
+		return
+	}
+
+	config, err := sso.discover(c.Request.Context())
+	if err != nil {
+		log.Printf("oidc discovery failed: %v", err)
+		ssoFailed(c, "Identity provider is unavailable")
+		return
+	}
+
+	state, nonce, verifier := randomURLString(16), randomURLString(16), randomURLString(32)
+	cookie, err := signOIDCState(state, nonce, verifier)
+	if err != nil {
+		ssoFailed(c, "Internal error")
+		return
+	}
+	setOIDCStateCookie(c, cookie, int(oidcStateTTL.Seconds()))
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.OIDCClientID},
+		"redirect_uri":          {cfg.OIDCRedirectURL},
+		"scope":                 {cfg.OIDCScopes},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	if c.Query("reauth") != "" {
+		q.Set("prompt", "login")
+		q.Set("max_age", "0")
+	}
+	sep := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	c.Redirect(http.StatusFound, config.AuthorizationEndpoint+sep+q.Encode())
+}
+
+// oidcCallback принимает код от провайдера, проверяет ID-токен и входит
+// под привязанным пользователем.
+func oidcCallback(c *gin.Context) {
+	if sso == nil {
+		ssoFailed(c, errOIDCDisabled.Error())
+		return
+	}
+
+	cookie, _ := c.Cookie(oidcStateCookie)
+	setOIDCStateCookie(c, "", -1)
+
+	if msg := c.Query("error"); msg != "" {
+		ssoFailed(c, "Identity provider: "+msg)
+		return
+	}
+	state, nonce, verifier, err := parseOIDCState(cookie)
+	if err != nil || state != c.Query("state") {
+		ssoFailed(c, "Login session expired, please try again")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+
+	config, err := sso.discover(ctx)
+	if err == nil {
+		var rawIDToken string
+		rawIDToken, err = sso.exchange(ctx, config, c.Query("code"), verifier)
+		if err == nil {
+			var claims *idTokenClaims
+			claims, err = sso.verifyIDToken(ctx, config, rawIDToken, nonce)
+			if err == nil {
+				completeSSOLogin(ctx, c, claims)
+				return
+			}
+		}
+	}
+	log.Printf("oidc login failed: %v", err)
+	ssoFailed(c, "Single sign-on failed")
+}
+
+func completeSSOLogin(ctx context.Context, c *gin.Context, claims *idTokenClaims) {
+	qctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	userID, role, err := linkIdentity(qctx, sso.issuer, claims)
+	if errors.Is(err, errOIDCEmailRequired) {
+		ssoFailed(c, "Your identity provider did not confirm the email address")
+		return
+	}
+	if errors.Is(err, errOIDCUnverified) {
+		ssoFailed(c, "Confirm your email address before signing in with SSO")
+		return
+	}
+	if err != nil {
+		log.Printf("oidc identity link failed: %v", err)
+		ssoFailed(c, "Database error")
+		return
+	}
+
+	// Второй фактор, если включён, нужен и при входе через SSO
+	enabled, _, err := twoFactor.Status(qctx, userID)
+	if err != nil {
+		ssoFailed(c, "Database error")
+		return
+	}
+	if enabled {
+		mfaToken, err := signMFAToken(userID, claims.AuthTime)
+		if err != nil {
+			ssoFailed(c, "Token error")
+			return
+		}
+		redirectToApp(c, url.Values{"mfa_token": {mfaToken}})
+		return
+	}
+
+	access, refresh, err := startSession(qctx, userID, role, claims.AuthTime)
+	if err != nil {
+		ssoFailed(c, "Token error")
+		return
+	}
+	if cookieMode() {
+		setAuthCookies(c, access, refresh)
+		c.Redirect(http.StatusFound, cfg.AppURL+"/")
+		return
+	}
+	redirectToApp(c, url.Values{"access_token": {access}, "refresh_token": {refresh}})
+}
+
+// linkIdentity находит пользователя по внешней учётной записи. При первом входе
+// она привязывается к пользователю с тем же подтверждённым email или к новому.
+// Неподтверждённому провайдером адресу не доверяем: иначе можно было бы
+// войти в чужой аккаунт, указав его email у провайдера. К локальному аккаунту
+// с неподтверждённым адресом тоже не привязываем: его мог зарегистрировать
+// кто угодно, и пароль злоумышленника продолжил бы работать рядом с SSO.
+func linkIdentity(ctx context.Context, issuer string, claims *idTokenClaims) (int, string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID int
+		role   string
+	)
+	err = tx.QueryRowContext(ctx, `
+        SELECT u.id, u.role FROM user_identities i JOIN users u ON u.id = i.user_id
+        WHERE i.issuer = $1 AND i.subject = $2`,
+		issuer, claims.Subject,
+	).Scan(&userID, &role)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE user_identities SET email = $1, last_login_at = NOW() WHERE issuer = $2 AND subject = $3",
+			claims.Email, issuer, claims.Subject,
+		)
+		if err != nil {
+			return 0, "", err
+		}
+		return userID, role, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, "", err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return 0, "", errOIDCEmailRequired
+	}
+
+	var verified bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT id, role, email_verified_at IS NOT NULL FROM users WHERE email = $1 FOR UPDATE",
+		claims.Email,
+	).Scan(&userID, &role, &verified)
+	switch {
+	case err == nil && !verified:
+		return 0, "", errOIDCUnverified
+	case errors.Is(err, sql.ErrNoRows):
+		// Пароля у такого пользователя нет; задать его можно через сброс пароля
+		role = roleForNewUser(claims.Email)
+		err = tx.QueryRowContext(ctx,
+			"INSERT INTO users (email, password_hash, role, email_verified_at) VALUES ($1, '', $2, NOW()) RETURNING id",
+			claims.Email, role,
+		).Scan(&userID)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO user_identities (issuer, subject, user_id, email, last_login_at) VALUES ($1, $2, $3, $4, NOW())",
+		issuer, claims.Subject, userID, claims.Email,
+	)
+	if err != nil {
+		return 0, "", err
+	}
+	return userID, role, tx.Commit()
+}
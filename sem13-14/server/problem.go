@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+
+	apiproblem "shared/problem"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ошибки API — apiproblem.Problem в формате RFC 7807; сам тип и перевод ошибок
+// БД общие для сервисов, здесь только ответы через gin.
+
+// respondProblem отвечает ошибкой и прерывает обработку запроса.
+func respondProblem(c *gin.Context, p *apiproblem.Problem) {
+	p.Instance = c.Request.URL.Path
+	// gin не перезаписывает уже выставленный Content-Type
+	c.Header("Content-Type", apiproblem.ContentType)
+	c.AbortWithStatusJSON(p.Status, p)
+}
+
+func problem(c *gin.Context, status int, code, detail string) {
+	respondProblem(c, apiproblem.New(status, code, detail))
+}
+
+func dbError(c *gin.Context, err error) {
+	respondProblem(c, apiproblem.FromDB(err, cfg.Production()))
+}
+
+func internalError(c *gin.Context, err error) {
+	respondProblem(c, apiproblem.Internal(err, cfg.Production()))
+}
+
+// recoverProblem отвечает на панику обработчика так же, как на любую внутреннюю ошибку.
+func recoverProblem(c *gin.Context, recovered any) {
+	internalError(c, fmt.Errorf("panic: %v", recovered))
+}
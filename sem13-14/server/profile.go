@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Смена адреса подтверждается письмом на новый адрес. Пока ссылка не открыта,
+// новый адрес лежит в users.pending_email, а токен привязан к нему через "fp":
+// повторный запрос смены делает старые ссылки недействительными.
+const (
+	tokenTypeEmailChange = "email_change"
+	emailChangeTTL       = 24 * time.Hour
+
+	// Как часто удаляются аккаунты, у которых истёк срок на отмену удаления
+	accountPurgeInterval = time.Hour
+)
+
+func sendEmailChangeEmail(ctx context.Context, userID int, newEmail string) error {
+	token, err := signEmailToken(tokenTypeEmailChange, userID, newEmail, emailChangeTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(ctx, MailMessage{
+		To:      newEmail,
+		Subject: "Confirm your new email",
+		Body: fmt.Sprintf("To use this address for your account, open the link:\n\n%s\n\nThe link is valid for %s.\n",
+			appLink("email_change_token", token), emailChangeTTL),
+	})
+}
+
+// currentUser загружает пользователя из access-токена. При ошибке сам отвечает
+// клиенту и возвращает nil.
+func currentUser(ctx context.Context, c *gin.Context) *auth.User {
+	user, err := users.ByID(ctx, c.GetInt("userID"))
+	if errors.Is(err, auth.ErrUserNotFound) {
+		problem(c, http.StatusNotFound, "user_not_found", "User not found")
+		return nil
+	}
+	if err != nil {
+		dbError(c, err)
+		return nil
+	}
+	return user
+}
+
+// checkCurrentPassword сверяет пароль для опасных операций. Неверный пароль
+// учитывается как неудачный вход, иначе украденным access-токеном можно было бы
+// перебирать пароль. У пользователей, созданных через SSO, пароля нет: вместо
+// него нужен недавний вход у провайдера (auth_time в токене не старше
+// REAUTH_MAX_AGE), фронтенд отправляет за ним на /api/oidc/login?reauth=1.
+func checkCurrentPassword(ctx context.Context, c *gin.Context, email, hash, password string) bool {
+	if hash == "" {
+		authTime, _ := c.Get("authTime")
+		if at, _ := authTime.(time.Time); time.Since(at) > cfg.ReauthMaxAge {
+			problem(c, http.StatusUnauthorized, "reauthentication_required", "Sign in with SSO again to confirm this action")
+			return false
+		}
+		return true
+	}
+
+	ip := c.ClientIP()
+	wait, err := throttle.Check(ctx, email, ip)
+	if err != nil {
+		internalError(c, err)
+		return false
+	}
+	if wait > 0 {
+		tooManyAttempts(ctx, c, email, ip, wait)
+		return false
+	}
+
+	if !auth.CheckPassword(hash, password) {
+		users.RecordLoginFailure(ctx, email, ip, "bad_password")
+		if err := throttle.Fail(ctx, email, ip); err != nil {
+			log.Printf("failed to update login throttle: %v", err)
+		}
+		problem(c, http.StatusUnauthorized, "invalid_password", "Invalid password")
+		return false
+	}
+	return true
+}
+
+// updateProfile меняет отображаемое имя и аватар. Отсутствующее поле не меняется,
+// пустая строка очищает его.
+func updateProfile(c *gin.Context) {
+	var req struct {
+		DisplayName *string `json:"display_name"`
+		AvatarURL   *string `json:"avatar_url"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	errs := fieldErrors{}
+	if req.DisplayName != nil {
+		*req.DisplayName = strings.TrimSpace(*req.DisplayName)
+		if msg := validateDisplayName(*req.DisplayName); msg != "" {
+			errs["display_name"] = msg
+		}
+	}
+	if req.AvatarURL != nil {
+		*req.AvatarURL = strings.TrimSpace(*req.AvatarURL)
+		if msg := validateAvatarURL(*req.AvatarURL); msg != "" {
+			errs["avatar_url"] = msg
+		}
+	}
+	if len(errs) > 0 {
+		respondProblem(c, validationFailed(errs))
+		return
+	}
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	var displayName, avatarURL sql.NullString
+	err := db.QueryRowContext(ctx, `
+        UPDATE users SET
+            display_name = CASE WHEN $2 THEN NULLIF($3, '') ELSE display_name END,
+            avatar_url = CASE WHEN $4 THEN NULLIF($5, '') ELSE avatar_url END
+        WHERE id = $1
+        RETURNING display_name, avatar_url`,
+		c.GetInt("userID"),
+		req.DisplayName != nil, valueOrEmpty(req.DisplayName),
+		req.AvatarURL != nil, valueOrEmpty(req.AvatarURL),
+	).Scan(&displayName, &avatarURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem(c, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"display_name": displayName.String, "avatar_url": avatarURL.String})
+}
+
+func valueOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// changeEmail отправляет ссылку подтверждения на новый адрес. Текущий адрес
+// остаётся в силе, пока ссылка не открыта.
+func changeEmail(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+	if msg := validateEmail(req.Email); msg != "" {
+		respondProblem(c, validationFailed(fieldErrors{"email": msg}))
+		return
+	}
+
+	id := c.GetInt("userID")
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user := currentUser(ctx, c)
+	if user == nil {
+		return
+	}
+	if !checkCurrentPassword(ctx, c, user.Email, user.PasswordHash, req.Password) {
+		return
+	}
+	if req.Email == user.Email {
+		respondProblem(c, validationFailed(fieldErrors{"email": "This is already your email"}))
+		return
+	}
+
+	var taken bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)", req.Email).Scan(&taken); err != nil {
+		dbError(c, err)
+		return
+	}
+	if taken {
+		problem(c, http.StatusConflict, "email_taken", "Email is already in use")
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE users SET pending_email = $1 WHERE id = $2", req.Email, id); err != nil {
+		dbError(c, err)
+		return
+	}
+	if err := sendEmailChangeEmail(ctx, id, req.Email); err != nil {
+		log.Printf("email change mail for user %d failed: %v", id, err)
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Check your new email to confirm the change"})
+}
+
+// confirmEmailChange применяет смену адреса по ссылке из письма и сообщает
+// об этом на старый адрес.
+func confirmEmailChange(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	userID, fp, err := parseEmailToken(req.Token, tokenTypeEmailChange)
+	if err != nil {
+		problem(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	var oldEmail string
+	var newEmail sql.NullString
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(email, ''), pending_email FROM users WHERE id = $1", userID).Scan(&oldEmail, &newEmail)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (!newEmail.Valid || fingerprint(newEmail.String) != fp)) {
+		problem(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE users SET email = pending_email, pending_email = NULL, email_verified_at = NOW() WHERE id = $1 AND pending_email = $2",
+		userID, newEmail.String,
+	)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		problem(c, http.StatusConflict, "email_taken", "Email is already in use")
+		return
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	err = mailer.Send(ctx, MailMessage{
+		To:      oldEmail,
+		Subject: "Your email was changed",
+		Body: fmt.Sprintf("The email for your account was changed to %s.\n\n"+
+			"If you did not do this, reset your password and contact support.\n", newEmail.String),
+	})
+	if err != nil {
+		log.Printf("email change notice for user %d failed: %v", userID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email changed", "email": newEmail.String})
+}
+
+// changePassword требует текущий пароль. Все остальные сессии завершаются,
+// текущая получает новую пару токенов.
+func changePassword(c *gin.Context) {
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	id := c.GetInt("userID")
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user := currentUser(ctx, c)
+	if user == nil {
+		return
+	}
+	if !checkCurrentPassword(ctx, c, user.Email, user.PasswordHash, req.CurrentPassword) {
+		return
+	}
+	if msg := auth.ValidatePassword(req.NewPassword, user.Email, cfg.PasswordPolicy); msg != "" {
+		respondProblem(c, validationFailed(fieldErrors{"new_password": msg}))
+		return
+	}
+
+	newHash, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET password_hash = $1 WHERE id = $2", newHash, id)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+			id,
+		)
+	}
+	var access, refresh string
+	if err == nil {
+		// Пароль только что подтверждён, новая сессия начинается как свежий вход
+		access, refresh, err = issueTokens(ctx, tx, id, user.Role, newTokenID(), time.Now())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	respondWithTokens(c, access, refresh)
+}
+
+// deleteAccount помечает аккаунт на удаление и завершает все сессии. До конца
+// срока AccountDeletionGrace можно войти и отменить удаление.
+func deleteAccount(c *gin.Context) {
+	var req struct {
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	id := c.GetInt("userID")
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user := currentUser(ctx, c)
+	if user == nil {
+		return
+	}
+	if !checkCurrentPassword(ctx, c, user.Email, user.PasswordHash, req.Password) {
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var requestedAt time.Time
+	err = tx.QueryRowContext(ctx,
+		"UPDATE users SET deletion_requested_at = COALESCE(deletion_requested_at, NOW()) WHERE id = $1 RETURNING deletion_requested_at",
+		id,
+	).Scan(&requestedAt)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+			id,
+		)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	deleteAt := requestedAt.Add(cfg.AccountDeletionGrace)
+	err = mailer.Send(ctx, MailMessage{
+		To:      user.Email,
+		Subject: "Your account will be deleted",
+		Body: fmt.Sprintf("Your account will be deleted on %s.\n\n"+
+			"To keep it, log in before then and cancel the deletion in your profile.\n", deleteAt.Format(time.RFC1123)),
+	})
+	if err != nil {
+		log.Printf("deletion notice for user %d failed: %v", id, err)
+	}
+
+	clearAuthCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Account scheduled for deletion", "deletion_scheduled_at": deleteAt})
+}
+
+func cancelAccountDeletion(c *gin.Context) {
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx,
+		"UPDATE users SET deletion_requested_at = NULL WHERE id = $1 AND deletion_requested_at IS NOT NULL",
+		c.GetInt("userID"),
+	)
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		problem(c, http.StatusBadRequest, "deletion_not_requested", "Account is not scheduled for deletion")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deletion cancelled"})
+}
+
+// runAccountPurge удаляет аккаунты, срок отмены удаления которых истёк. Токены,
+// привязки SSO и второй фактор удаляются каскадом.
+func runAccountPurge() {
+	ticker := time.NewTicker(accountPurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DB.QueryTimeout)
+		res, err := db.ExecContext(ctx,
+			"DELETE FROM users WHERE deletion_requested_at < $1",
+			time.Now().Add(-cfg.AccountDeletionGrace),
+		)
+		if err != nil {
+			log.Printf("account purge failed: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("account purge: deleted %d accounts", n)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ограничение частоты запросов — token bucket в записи GCRA: вместо числа
+// токенов хранится «теоретическое время прибытия» (TAT) следующего запроса.
+// Каждый запрос сдвигает TAT на Period/Burst; запрос отклоняется, если TAT
+// ушёл в будущее дальше чем на Period, то есть корзина пуста.
+// Корзина заводится на группу маршрутов и клиента: пользователя из токена
+// или, для анонимных запросов, IP-адрес.
+
+// RateLimit — лимит группы маршрутов. Нулевой Burst выключает лимит.
+type RateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// parseRateLimit разбирает значение вида "60/1m"; "off" выключает лимит.
+func parseRateLimit(value string) (RateLimit, error) {
+	if value == "off" {
+		return RateLimit{}, nil
+	}
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected <requests>/<period>", value)
+	}
+	burst, err := strconv.Atoi(count)
+	if err != nil || burst <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: bad request count", value)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d < time.Millisecond {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: period must be at least 1ms", value)
+	}
+	return RateLimit{Burst: burst, Period: d}, nil
+}
+
+// interval — через сколько восстанавливается один токен.
+func (l RateLimit) interval() time.Duration {
+	return l.Period / time.Duration(l.Burst)
+}
+
+// rateDecision — результат запроса к корзине.
+type rateDecision struct {
+	Allowed   bool
+	Remaining int
+	// Через сколько корзина наполнится полностью
+	Reset time.Duration
+	// Через сколько появится следующий токен; имеет смысл, если запрос отклонён
+	RetryAfter time.Duration
+}
+
+// decide вычисляет ответ по тому, насколько TAT опережает текущее время.
+func decide(l RateLimit, allowed bool, ahead time.Duration) rateDecision {
+	ahead = max(ahead, 0)
+	d := rateDecision{
+		Allowed:   allowed,
+		Remaining: max(int((l.Period-ahead)/l.interval()), 0),
+		Reset:     ahead,
+	}
+	if !allowed {
+		d.RetryAfter = ahead + l.interval() - l.Period
+	}
+	return d
+}
+
+// rateStore хранит TAT корзин. Реализация выбирается через RATE_LIMIT_STORE:
+// memory подходит для одной реплики, postgres — для нескольких.
+type rateStore interface {
+	take(ctx context.Context, key string, limit RateLimit) (rateDecision, error)
+}
+
+var rateLimits rateStore
+
+func newRateStore(cfg *Config) (rateStore, error) {
+	switch cfg.RateLimitStore {
+	case "memory":
+		return newMemoryRateStore(), nil
+	case "postgres":
+		go runRateLimitPurge()
+		return pgRateStore{}, nil
+	default:
+		return nil, errors.New("RATE_LIMIT_STORE must be memory or postgres")
+	}
+}
+
+type memoryRateStore struct {
+	mu  sync.Mutex
+	tat map[string]time.Time
+}
+
+func newMemoryRateStore() *memoryRateStore {
+	return &memoryRateStore{tat: map[string]time.Time{}}
+}
+
+func (s *memoryRateStore) take(_ context.Context, key string, limit RateLimit) (rateDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	tat := s.tat[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(limit.interval())
+	if next.Sub(now) > limit.Period {
+		return decide(limit, false, tat.Sub(now)), nil
+	}
+	s.tat[key] = next
+	s.prune(now)
+	return decide(limit, true, next.Sub(now)), nil
+}
+
+// prune не даёт карте расти бесконечно: корзины с прошедшим TAT полны и не нужны.
+func (s *memoryRateStore) prune(now time.Time) {
+	if len(s.tat) < 10000 {
+		return
+	}
+	for key, tat := range s.tat {
+		if tat.Before(now) {
+			delete(s.tat, key)
+		}
+	}
+}
+
+// pgRateStore хранит TAT в таблице rate_limits. Запрос, которому не хватило
+// токена, не меняет строку: условие WHERE в ON CONFLICT отсекает обновление,
+// и RETURNING ничего не возвращает.
+type pgRateStore struct{}
+
+func (pgRateStore) take(ctx context.Context, key string, limit RateLimit) (rateDecision, error) {
+	var ahead float64
+	err := db.QueryRowContext(ctx, `
+        INSERT INTO rate_limits (key, tat) VALUES ($1, NOW() + $2 * INTERVAL '1 second')
+        ON CONFLICT (key) DO UPDATE SET
+            tat = GREATEST(rate_limits.tat, NOW()) + $2 * INTERVAL '1 second'
+        WHERE GREATEST(rate_limits.tat, NOW()) + $2 * INTERVAL '1 second' <= NOW() + $3 * INTERVAL '1 second'
+        RETURNING EXTRACT(EPOCH FROM tat - NOW())`,
+		key, limit.interval().Seconds(), limit.Period.Seconds(),
+	).Scan(&ahead)
+	if err == nil {
+		return decide(limit, true, seconds(ahead)), nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return rateDecision{}, err
+	}
+
+	err = db.QueryRowContext(ctx,
+		"SELECT EXTRACT(EPOCH FROM tat - NOW()) FROM rate_limits WHERE key = $1", key,
+	).Scan(&ahead)
+	if err != nil {
+		return rateDecision{}, err
+	}
+	return decide(limit, false, seconds(ahead)), nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+const rateLimitPurgeInterval = time.Hour
+
+// runRateLimitPurge удаляет полные корзины, чтобы таблица не росла от разовых клиентов.
+func runRateLimitPurge() {
+	ticker := time.NewTicker(rateLimitPurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DB.QueryTimeout)
+		if _, err := db.ExecContext(ctx, "DELETE FROM rate_limits WHERE tat < NOW()"); err != nil {
+			log.Printf("rate limit purge failed: %v", err)
+		}
+		cancel()
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimit ограничивает частоту запросов к группе маршрутов. В группе /auth
+// ставится после authMiddleware, чтобы пользователи считались по ID. Если
+// хранилище недоступно, запрос пропускается: лимит не должен ронять API.
+func rateLimit(group string, limit RateLimit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit.Burst == 0 {
+			c.Next()
+			return
+		}
+		key := "ip:" + c.ClientIP()
+		if userID, ok := c.Get("userID"); ok {
+			key = fmt.Sprintf("user:%d", userID)
+		}
+
+		ctx, cancel := queryContext(c.Request.Context())
+		d, err := rateLimits.take(ctx, group+":"+key, limit)
+		cancel()
+		if err != nil {
+			log.Printf("rate limit unavailable: %v", err)
+			c.Next()
+			return
+		}
+
+		// Заголовки RateLimit-* по draft-ietf-httpapi-ratelimit-headers
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, int(limit.Period.Seconds())))
+		c.Header("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		c.Header("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+		if !d.Allowed {
+			c.Header("Retry-After", strconv.Itoa(max(1, ceilSeconds(d.RetryAfter))))
+			problem(c, http.StatusTooManyRequests, "rate_limited", "Too many requests")
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Роли пользователей. Роль попадает в claims токенов и проверяется
+// сервисами, которые эти токены принимают (например, бэкендом продуктов task10).
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+var roleLevels = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleAdmin:  3,
+}
+
+func validRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
+// roleForNewUser выдаёт роль admin адресам из ADMIN_EMAILS, остальным — viewer.
+func roleForNewUser(email string) string {
+	for _, admin := range cfg.AdminEmails {
+		if normalizeEmail(admin) == email {
+			return roleAdmin
+		}
+	}
+	return roleViewer
+}
+
+// requireRole пропускает запрос, если роль из токена не ниже указанной.
+// Должен стоять после authMiddleware.
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if roleLevels[c.GetString("role")] < roleLevels[role] {
+			problem(c, http.StatusForbidden, "forbidden", "Insufficient role")
+			return
+		}
+		c.Next()
+	}
+}
+
+// setUserRole меняет роль пользователя. Новая роль попадёт в токены
+// при следующем входе или обновлении токенов.
+func setUserRole(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Invalid user id")
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !validRole(req.Role) {
+		problem(c, http.StatusBadRequest, "invalid_role", "Role must be one of viewer, editor, admin")
+		return
+	}
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "UPDATE users SET role = $1 WHERE id = $2", req.Role, id)
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		problem(c, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "role": req.Role})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// attemptStore хранит счётчики неудачных входов и блокировки. Реализация
+// выбирается через LOGIN_THROTTLE_STORE: memory подходит для одной реплики,
+// postgres — для нескольких.
+type attemptStore interface {
+	// Incr увеличивает счётчик неудач по ключу. Счётчик сбрасывается,
+	// если неудач не было дольше window.
+	Incr(ctx context.Context, key string, window time.Duration) (int, error)
+	Lock(ctx context.Context, key string, d time.Duration) error
+	// LockedFor возвращает оставшееся время блокировки или 0.
+	LockedFor(ctx context.Context, key string) (time.Duration, error)
+	Reset(ctx context.Context, key string) error
+}
+
+// throttlePolicy: после Threshold неудач подряд ключ блокируется на BaseDelay,
+// и каждая следующая неудача удваивает блокировку вплоть до MaxDelay.
+type throttlePolicy struct {
+	Threshold int
+	Window    time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func (p throttlePolicy) delay(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	exp := math.Min(float64(failures-p.Threshold), 30)
+	return min(time.Duration(float64(p.BaseDelay)*math.Pow(2, exp)), p.MaxDelay)
+}
+
+type loginThrottle struct {
+	store         attemptStore
+	accountPolicy throttlePolicy
+	ipPolicy      throttlePolicy
+}
+
+var throttle *loginThrottle
+
+func newLoginThrottle(cfg *Config) (*loginThrottle, error) {
+	var store attemptStore
+	switch cfg.LoginThrottleStore {
+	case "memory":
+		store = newMemoryAttemptStore()
+	case "postgres":
+		store = &pgAttemptStore{}
+	default:
+		return nil, errors.New("LOGIN_THROTTLE_STORE must be memory or postgres")
+	}
+
+	return &loginThrottle{
+		store: store,
+		accountPolicy: throttlePolicy{
+			Threshold: cfg.LoginMaxAccountFailures,
+			Window:    cfg.LoginFailureWindow,
+			BaseDelay: cfg.LoginLockoutBase,
+			MaxDelay:  cfg.LoginLockoutMax,
+		},
+		ipPolicy: throttlePolicy{
+			Threshold: cfg.LoginMaxIPFailures,
+			Window:    cfg.LoginFailureWindow,
+			BaseDelay: cfg.LoginLockoutBase,
+			MaxDelay:  cfg.LoginLockoutMax,
+		},
+	}, nil
+}
+
+func accountKey(email string) string { return "account:" + email }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+// Check возвращает, сколько ждать до следующей попытки входа; 0 — можно пробовать.
+// Проверяется до bcrypt, чтобы перебор не нагружал CPU.
+func (t *loginThrottle) Check(ctx context.Context, email, ip string) (time.Duration, error) {
+	account, err := t.store.LockedFor(ctx, accountKey(email))
+	if err != nil {
+		return 0, err
+	}
+	byIP, err := t.store.LockedFor(ctx, ipKey(ip))
+	if err != nil {
+		return 0, err
+	}
+	return max(account, byIP), nil
+}
+
+// Fail учитывает неудачную попытку и при необходимости блокирует аккаунт и IP.
+func (t *loginThrottle) Fail(ctx context.Context, email, ip string) error {
+	for _, item := range []struct {
+		key    string
+		policy throttlePolicy
+	}{
+		{accountKey(email), t.accountPolicy},
+		{ipKey(ip), t.ipPolicy},
+	} {
+		failures, err := t.store.Incr(ctx, item.key, item.policy.Window)
+		if err != nil {
+			return err
+		}
+		if d := item.policy.delay(failures); d > 0 {
+			if err := t.store.Lock(ctx, item.key, d); err != nil {
+				return err
+			}
+			log.Printf("login throttled: %s locked for %s after %d failures", item.key, d, failures)
+		}
+	}
+	return nil
+}
+
+// Succeed сбрасывает счётчик аккаунта. Счётчик IP не сбрасывается: с одного
+// адреса могут перебирать много аккаунтов, угадав пароль к одному из них.
+func (t *loginThrottle) Succeed(ctx context.Context, email string) error {
+	return t.store.Reset(ctx, accountKey(email))
+}
+
+type memoryAttempt struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type memoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*memoryAttempt
+}
+
+func newMemoryAttemptStore() *memoryAttemptStore {
+	return &memoryAttemptStore{attempts: map[string]*memoryAttempt{}}
+}
+
+func (s *memoryAttemptStore) Incr(_ context.Context, key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	a := s.attempts[key]
+	if a == nil || now.Sub(a.lastFailure) > window {
+		a = &memoryAttempt{lockedUntil: s.lockedUntil(key)}
+		s.attempts[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+	s.prune(now, window)
+	return a.failures, nil
+}
+
+func (s *memoryAttemptStore) lockedUntil(key string) time.Time {
+	if a := s.attempts[key]; a != nil {
+		return a.lockedUntil
+	}
+	return time.Time{}
+}
+
+// prune не даёт карте расти бесконечно при переборе с множества адресов.
+func (s *memoryAttemptStore) prune(now time.Time, window time.Duration) {
+	if len(s.attempts) < 10000 {
+		return
+	}
+	for key, a := range s.attempts {
+		if now.Sub(a.lastFailure) > window && now.After(a.lockedUntil) {
+			delete(s.attempts, key)
+		}
+	}
+}
+
+func (s *memoryAttemptStore) Lock(_ context.Context, key string, d time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a := s.attempts[key]; a != nil {
+		a.lockedUntil = time.Now().Add(d)
+	}
+	return nil
+}
+
+func (s *memoryAttemptStore) LockedFor(_ context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return max(time.Until(s.lockedUntil(key)), 0), nil
+}
+
+func (s *memoryAttemptStore) Reset(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// pgAttemptStore хранит счётчики в таблице login_throttle.
+type pgAttemptStore struct{}
+
+func (pgAttemptStore) Incr(ctx context.Context, key string, window time.Duration) (int, error) {
+	var failures int
+	err := db.QueryRowContext(ctx, `
+        INSERT INTO login_throttle (key, failures, last_failure) VALUES ($1, 1, NOW())
+        ON CONFLICT (key) DO UPDATE SET
+            failures = CASE WHEN login_throttle.last_failure < NOW() - $2 * INTERVAL '1 second'
+                THEN 1 ELSE login_throttle.failures + 1 END,
+            last_failure = NOW()
+        RETURNING failures`,
+		key, window.Seconds(),
+	).Scan(&failures)
+	return failures, err
+}
+
+func (pgAttemptStore) Lock(ctx context.Context, key string, d time.Duration) error {
+	_, err := db.ExecContext(ctx,
+		"UPDATE login_throttle SET locked_until = NOW() + $2 * INTERVAL '1 second' WHERE key = $1",
+		key, d.Seconds(),
+	)
+	return err
+}
+
+func (pgAttemptStore) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	var seconds float64
+	err := db.QueryRowContext(ctx,
+		"SELECT GREATEST(EXTRACT(EPOCH FROM locked_until - NOW()), 0) FROM login_throttle WHERE key = $1 AND locked_until IS NOT NULL",
+		key,
+	).Scan(&seconds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return time.Duration(seconds * float64(time.Second)), err
+}
+
+func (pgAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM login_throttle WHERE key = $1", key)
+	return err
+}
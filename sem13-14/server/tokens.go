@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 168 * time.Hour
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Значения claim "typ". Сервис, принимающий токен, обязан проверить тип:
+// refresh-токен не должен работать как access и наоборот.
+const (
+	tokenTypeAccess  = auth.TokenTypeAccess
+	tokenTypeRefresh = "refresh"
+	// Выдаётся после пароля, если включён второй фактор; обменивается на пару токенов в /login/2fa
+	tokenTypeMFA = "mfa"
+)
+
+// internalToken — токены, которые принимает только сам сервис авторизации.
+func internalToken(typ string) bool {
+	return typ == tokenTypeRefresh || typ == tokenTypeMFA
+}
+
+// audience: access-токены предназначены сервисам из JWTAudience,
+// остальные принимает только сам сервис авторизации.
+func audience(typ string) string {
+	if internalToken(typ) {
+		return cfg.JWTIssuer
+	}
+	return cfg.JWTAudience
+}
+
+func signToken(typ, tokenID string, ttl time.Duration, claims jwt.MapClaims) (string, error) {
+	now := time.Now()
+	claims["typ"] = typ
+	claims["iss"] = cfg.JWTIssuer
+	claims["aud"] = audience(typ)
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+	claims["jti"] = tokenID
+
+	// Refresh- и mfa-токены проверяет только сам сервис, поэтому для них достаточно секрета
+	if internalToken(typ) {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(cfg.JWTRefreshSecret))
+	}
+
+	key := signingKeys.current()
+	if key == nil {
+		return "", errNoSigningKey
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// verificationKey выбирает ключ проверки: секрет для внутренних токенов,
+// открытый ключ по kid для access-токенов.
+func verificationKey(typ string) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		if internalToken(typ) {
+			if t.Method != jwt.SigningMethodHS256 {
+				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+			}
+			return []byte(cfg.JWTRefreshSecret), nil
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		key := signingKeys.lookup(kid)
+		if key == nil {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		if t.Method.Alg() != key.Alg {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return key.Private.Public(), nil
+	}
+}
+
+// jwtSigner подписывает токены для auth.TokenStrategy ключами сервиса.
+type jwtSigner struct{}
+
+func (jwtSigner) Sign(typ string, ttl time.Duration, claims map[string]any) (string, error) {
+	return signToken(typ, newTokenID(), ttl, jwt.MapClaims(claims))
+}
+
+var accessTokens = auth.TokenStrategy{Signer: jwtSigner{}, TTL: accessTokenTTL}
+
+// generateTokens выпускает пару токенов. authTime переходит из refresh-токена
+// в следующие при ротации, поэтому обновление токенов не делает вход «свежим».
+func generateTokens(userID int, role, tokenID, familyID string, authTime time.Time) (string, string, error) {
+	access, err := accessTokens.Issue(&auth.User{ID: userID, Role: role}, authTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	refresh, err := signToken(tokenTypeRefresh, tokenID, refreshTokenTTL, jwt.MapClaims{
+		"sub":       strconv.Itoa(userID),
+		"fid":       familyID,
+		"auth_time": authTime.Unix(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// parseToken проверяет подпись ключом нужного типа, срок действия, издателя,
+// аудиторию и claim typ. Возвращает ID пользователя из sub и все claims.
+func parseToken(tokenString, typ string) (int, jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, verificationKey(typ),
+		jwt.WithValidMethods([]string{"HS256", "EdDSA", "RS256"}),
+		jwt.WithIssuer(cfg.JWTIssuer),
+		jwt.WithAudience(audience(typ)),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if claims["typ"] != typ {
+		return 0, nil, fmt.Errorf("expected %s token", typ)
+	}
+	if jti, _ := claims["jti"].(string); jti == "" {
+		return 0, nil, errors.New("missing jti claim")
+	}
+	sub, _ := claims["sub"].(string)
+	userID, err := strconv.Atoi(sub)
+	if err != nil {
+		return 0, nil, errors.New("invalid sub claim")
+	}
+	return userID, claims, nil
+}
+
+// claimAuthTime читает claim auth_time. У токенов, выпущенных до его появления,
+// claim нет, и вход считается давним.
+func claimAuthTime(claims jwt.MapClaims) time.Time {
+	if sec, ok := claims["auth_time"].(float64); ok {
+		return time.Unix(int64(sec), 0)
+	}
+	return time.Time{}
+}
+
+// execer — общее у *sql.DB и *sql.Tx, чтобы выпускать токены и внутри транзакции ротации.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// issueTokens выпускает пару токенов и сохраняет refresh-токен в семействе familyID.
+// Семейство — это одна цепочка ротаций, начатая одним входом.
+func issueTokens(ctx context.Context, q execer, userID int, role, familyID string, authTime time.Time) (string, string, error) {
+	tokenID := newTokenID()
+	access, refresh, err := generateTokens(userID, role, tokenID, familyID, authTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = q.ExecContext(ctx,
+		"INSERT INTO refresh_tokens (id, user_id, family_id, expires_at) VALUES ($1, $2, $3, $4)",
+		tokenID, userID, familyID, time.Now().Add(refreshTokenTTL),
+	)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+type refreshClaims struct {
+	UserID   int
+	TokenID  string
+	FamilyID string
+	AuthTime time.Time
+}
+
+func parseRefreshToken(tokenString string) (*refreshClaims, error) {
+	userID, claims, err := parseToken(tokenString, tokenTypeRefresh)
+	if err != nil {
+		return nil, errRefreshTokenInvalid
+	}
+
+	familyID, _ := claims["fid"].(string)
+	if familyID == "" {
+		return nil, errRefreshTokenInvalid
+	}
+	return &refreshClaims{
+		UserID:   userID,
+		TokenID:  claims["jti"].(string),
+		FamilyID: familyID,
+		AuthTime: claimAuthTime(claims),
+	}, nil
+}
+
+// rotateRefreshToken погашает refresh-токен и выпускает новую пару в том же семействе.
+// Повторное предъявление уже использованного токена означает, что он утёк:
+// тогда отзывается всё семейство, и выйти из него придётся обоим владельцам.
+func rotateRefreshToken(ctx context.Context, claims *refreshClaims) (string, string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		usedAt, revokedAt sql.NullTime
+		expiresAt         time.Time
+		role              string
+	)
+	err = tx.QueryRowContext(ctx, `
+        SELECT t.used_at, t.revoked_at, t.expires_at, u.role
+        FROM refresh_tokens t JOIN users u ON u.id = t.user_id
+        WHERE t.id = $1 AND t.user_id = $2
+        FOR UPDATE OF t`,
+		claims.TokenID, claims.UserID,
+	).Scan(&usedAt, &revokedAt, &expiresAt, &role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", errRefreshTokenInvalid
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return "", "", errRefreshTokenInvalid
+	}
+	if usedAt.Valid {
+		if _, err := revokeFamily(ctx, tx, claims.FamilyID); err != nil {
+			return "", "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return "", "", err
+		}
+		log.Printf("refresh token reuse detected: user %d, family %s revoked", claims.UserID, claims.FamilyID)
+		return "", "", errRefreshTokenReused
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1", claims.TokenID); err != nil {
+		return "", "", err
+	}
+	access, refresh, err := issueTokens(ctx, tx, claims.UserID, role, claims.FamilyID, claims.AuthTime)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, tx.Commit()
+}
+
+func revokeFamily(ctx context.Context, q execer, familyID string) (sql.Result, error) {
+	return q.ExecContext(ctx,
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL",
+		familyID,
+	)
+}
+
+func refreshToken(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	// В режиме кук тело может быть пустым: токен придёт в куке
+	if err := c.ShouldBindJSON(&req); err != nil && !cookieMode() {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	claims, err := parseRefreshToken(requestRefreshToken(c, req.RefreshToken))
+	if err != nil {
+		problem(c, http.StatusUnauthorized, "invalid_token", "Invalid token")
+		return
+	}
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	access, refresh, err := rotateRefreshToken(ctx, claims)
+	if errors.Is(err, errRefreshTokenReused) {
+		problem(c, http.StatusUnauthorized, "token_reused", "Refresh token reuse detected, please log in again")
+		return
+	}
+	if errors.Is(err, errRefreshTokenInvalid) {
+		problem(c, http.StatusUnauthorized, "invalid_token", "Invalid token")
+		return
+	}
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	respondWithTokens(c, access, refresh)
+}
+
+// logout завершает текущую сессию: отзывает семейство переданного refresh-токена.
+// Уже выданный access-токен остаётся действительным до истечения срока.
+func logout(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	// В режиме кук тело может быть пустым: токен придёт в куке
+	if err := c.ShouldBindJSON(&req); err != nil && !cookieMode() {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	claims, err := parseRefreshToken(requestRefreshToken(c, req.RefreshToken))
+	if err != nil {
+		problem(c, http.StatusUnauthorized, "invalid_token", "Invalid token")
+		return
+	}
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	if _, err := revokeFamily(ctx, db, claims.FamilyID); err != nil {
+		dbError(c, err)
+		return
+	}
+
+	clearAuthCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// logoutAll отзывает refresh-токены пользователя на всех устройствах.
+func logoutAll(c *gin.Context) {
+	id := c.GetInt("userID")
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx,
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+		id,
+	)
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+	revoked, _ := res.RowsAffected()
+	clearAuthCookies(c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out everywhere", "revoked": revoked})
+}
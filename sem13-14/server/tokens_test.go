@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// withTestKeys подменяет конфигурацию и ключи подписи: новый ключ EdDSA
+// и выведенный из ротации RS256, который ещё принимается.
+func withTestKeys(t *testing.T) (current, previous *jwtKey) {
+	t.Helper()
+	prevCfg, prevKeys := cfg, signingKeys
+	t.Cleanup(func() { cfg, signingKeys = prevCfg, prevKeys })
+
+	cfg = &Config{JWTRefreshSecret: "refresh-secret", JWTIssuer: "auth-service", JWTAudience: "front2sem"}
+	current, previous = &jwtKey{ID: "new", Alg: "EdDSA"}, &jwtKey{ID: "old", Alg: "RS256"}
+	for _, key := range []*jwtKey{current, previous} {
+		private, err := generatePrivateKey(key.Alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key.Private = private
+	}
+	signingKeys = &keyStore{keys: []*jwtKey{current, previous}}
+	return current, previous
+}
+
+func testClaims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": "42", "role": "user"}
+}
+
+func TestParseTokenTypes(t *testing.T) {
+	withTestKeys(t)
+
+	for _, typ := range []string{tokenTypeAccess, tokenTypeRefresh, tokenTypeMFA} {
+		token, err := signToken(typ, newTokenID(), time.Minute, testClaims())
+		if err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		userID, claims, err := parseToken(token, typ)
+		if err != nil || userID != 42 || claims["typ"] != typ {
+			t.Errorf("%s: got %d, %v", typ, userID, err)
+		}
+
+		// Токен одного типа не принимается вместо другого
+		for _, other := range []string{tokenTypeAccess, tokenTypeRefresh, tokenTypeMFA} {
+			if other == typ {
+				continue
+			}
+			if _, _, err := parseToken(token, other); err == nil {
+				t.Errorf("%s token accepted as %s", typ, other)
+			}
+		}
+	}
+}
+
+func TestParseTokenPreviousKey(t *testing.T) {
+	_, previous := withTestKeys(t)
+
+	claims := testClaims()
+	claims["typ"] = tokenTypeAccess
+	claims["iss"] = cfg.JWTIssuer
+	claims["aud"] = cfg.JWTAudience
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	claims["jti"] = newTokenID()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = previous.ID
+	signed, err := token.SignedString(previous.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseToken(signed, tokenTypeAccess); err != nil {
+		t.Fatalf("token signed with the previous key rejected: %v", err)
+	}
+}
+
+func TestParseTokenRejectsWrongAlgorithm(t *testing.T) {
+	current, previous := withTestKeys(t)
+
+	sign := func(method jwt.SigningMethod, kid, typ string, key interface{}) string {
+		claims := testClaims()
+		claims["typ"] = typ
+		claims["iss"] = cfg.JWTIssuer
+		claims["aud"] = audience(typ)
+		claims["iat"] = time.Now().Unix()
+		claims["exp"] = time.Now().Add(time.Minute).Unix()
+		claims["jti"] = newTokenID()
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := map[string]struct {
+		token, typ string
+	}{
+		// Access-токен, подписанный секретом refresh-токенов
+		"HS256 access": {sign(jwt.SigningMethodHS256, current.ID, tokenTypeAccess, []byte(cfg.JWTRefreshSecret)), tokenTypeAccess},
+		// Refresh-токен, подписанный ключом access-токенов
+		"EdDSA refresh": {sign(jwt.SigningMethodEdDSA, current.ID, tokenTypeRefresh, current.Private), tokenTypeRefresh},
+		// Алгоритм токена не совпадает с алгоритмом ключа из kid
+		"RS256 with EdDSA kid": {sign(jwt.SigningMethodRS256, current.ID, tokenTypeAccess, previous.Private), tokenTypeAccess},
+		"unknown kid":          {sign(jwt.SigningMethodEdDSA, "missing", tokenTypeAccess, current.Private), tokenTypeAccess},
+		"none":                 {sign(jwt.SigningMethodNone, current.ID, tokenTypeAccess, jwt.UnsafeAllowNoneSignatureType), tokenTypeAccess},
+	}
+	for name, tt := range tests {
+		if _, _, err := parseToken(tt.token, tt.typ); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestParseTokenRequiresJTI(t *testing.T) {
+	withTestKeys(t)
+
+	token, err := signToken(tokenTypeRefresh, "", time.Minute, testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseToken(token, tokenTypeRefresh); err == nil {
+		t.Fatal("token without jti accepted")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"auth"
+	"auth/totp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Сколько действует mfa-токен между вводом пароля и кода.
+const mfaTokenTTL = 5 * time.Minute
+
+var twoFactor *totp.Store
+
+// signMFAToken запоминает в mfa-токене время первого шага входа: оно
+// попадёт в auth_time выданных после второго фактора токенов.
+func signMFAToken(userID int, authTime time.Time) (string, error) {
+	return signToken(tokenTypeMFA, newTokenID(), mfaTokenTTL, jwt.MapClaims{
+		"sub":       strconv.Itoa(userID),
+		"auth_time": authTime.Unix(),
+	})
+}
+
+// checkSecondFactor проверяет TOTP-код или код восстановления. Неверные коды
+// считаются неудачными входами, как и неверные пароли. При ошибке сам отвечает
+// клиенту и возвращает false.
+func checkSecondFactor(ctx context.Context, c *gin.Context, userID int, email, code string) bool {
+	ip := c.ClientIP()
+
+	wait, err := throttle.Check(ctx, email, ip)
+	if err != nil {
+		internalError(c, err)
+		return false
+	}
+	if wait > 0 {
+		tooManyAttempts(ctx, c, email, ip, wait)
+		return false
+	}
+
+	err = twoFactor.Verify(ctx, userID, code)
+	if errors.Is(err, totp.ErrInvalidCode) {
+		users.RecordLoginFailure(ctx, email, ip, "bad_2fa_code")
+		if err := throttle.Fail(ctx, email, ip); err != nil {
+			log.Printf("failed to update login throttle: %v", err)
+		}
+		problem(c, http.StatusUnauthorized, "invalid_two_factor_code", "Invalid two-factor code")
+		return false
+	}
+	if errors.Is(err, totp.ErrNotEnabled) {
+		problem(c, http.StatusBadRequest, "two_factor_disabled", "Two-factor authentication is not enabled")
+		return false
+	}
+	if err != nil {
+		dbError(c, err)
+		return false
+	}
+
+	if err := throttle.Succeed(ctx, email); err != nil {
+		log.Printf("failed to reset login throttle: %v", err)
+	}
+	return true
+}
+
+// loginTwoFactor — второй шаг входа: mfa-токен из /login и код из приложения
+// или код восстановления.
+func loginTwoFactor(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	userID, claims, err := parseToken(req.MFAToken, tokenTypeMFA)
+	if err != nil {
+		problem(c, http.StatusUnauthorized, "invalid_token", "Invalid or expired token, please log in again")
+		return
+	}
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user, err := users.ByID(ctx, userID)
+	if errors.Is(err, auth.ErrUserNotFound) {
+		problem(c, http.StatusUnauthorized, "invalid_token", "Invalid or expired token, please log in again")
+		return
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	if !checkSecondFactor(ctx, c, userID, user.Email, req.Code) {
+		return
+	}
+	completeLogin(ctx, c, userID, user.Role, claimAuthTime(claims))
+}
+
+func twoFactorStatus(c *gin.Context) {
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	enabled, recoveryCodes, err := twoFactor.Status(ctx, c.GetInt("userID"))
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enabled": enabled, "recovery_codes_left": recoveryCodes})
+}
+
+// setupTwoFactor выдаёт секрет и otpauth-ссылку для QR-кода. Второй фактор
+// заработает после подтверждения кодом в /auth/2fa/enable.
+func setupTwoFactor(c *gin.Context) {
+	id := c.GetInt("userID")
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user := currentUser(ctx, c)
+	if user == nil {
+		return
+	}
+
+	secret, uri, err := twoFactor.Setup(ctx, id, cfg.TOTPIssuer, user.Name())
+	if errors.Is(err, totp.ErrAlreadyEnabled) {
+		problem(c, http.StatusConflict, "two_factor_enabled", "Two-factor authentication is already enabled")
+		return
+	}
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+}
+
+func enableTwoFactor(c *gin.Context) {
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	codes, err := twoFactor.Enable(ctx, c.GetInt("userID"), req.Code)
+	switch {
+	case errors.Is(err, totp.ErrInvalidCode):
+		problem(c, http.StatusBadRequest, "invalid_two_factor_code", "Invalid two-factor code")
+	case errors.Is(err, totp.ErrNotEnrolled):
+		problem(c, http.StatusBadRequest, "two_factor_setup_required", "Start two-factor setup first")
+	case errors.Is(err, totp.ErrAlreadyEnabled):
+		problem(c, http.StatusConflict, "two_factor_enabled", "Two-factor authentication is already enabled")
+	case err != nil:
+		dbError(c, err)
+	default:
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+	}
+}
+
+// disableTwoFactor требует и пароль (или свежий вход через SSO), и код: одного
+// украденного access-токена мало.
+func disableTwoFactor(c *gin.Context) {
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	id := c.GetInt("userID")
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user := currentUser(ctx, c)
+	if user == nil {
+		return
+	}
+	if !checkCurrentPassword(ctx, c, user.Email, user.PasswordHash, req.Password) {
+		return
+	}
+
+	if !checkSecondFactor(ctx, c, id, user.Email, req.Code) {
+		return
+	}
+	if err := twoFactor.Disable(ctx, id); err != nil {
+		dbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// regenerateRecoveryCodes заменяет коды восстановления; старые перестают действовать.
+func regenerateRecoveryCodes(c *gin.Context) {
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem(c, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	id := c.GetInt("userID")
+
+	ctx, cancel := queryContext(c.Request.Context())
+	defer cancel()
+
+	user := currentUser(ctx, c)
+	if user == nil {
+		return
+	}
+
+	if !checkSecondFactor(ctx, c, id, user.Email, req.Code) {
+		return
+	}
+	codes, err := twoFactor.RegenerateRecoveryCodes(ctx, id)
+	if err != nil {
+		dbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	apiproblem "shared/problem"
+)
+
+// fieldErrors — ошибки проверки по полям запроса, отдаются клиенту как есть.
+type fieldErrors map[string]string
+
+func validationFailed(errs fieldErrors) *apiproblem.Problem {
+	p := apiproblem.New(http.StatusBadRequest, "validation_failed", "Validation failed")
+	p.Fields = errs
+	return p
+}
+
+// normalizeEmail убирает пробелы по краям и приводит адрес к нижнему регистру,
+// чтобы User@Example.com и user@example.com были одним аккаунтом.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func validateEmail(email string) string {
+	if email == "" {
+		return "Email is required"
+	}
+	if len(email) > 254 {
+		return "Email is too long"
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "Invalid email format"
+	}
+	at := strings.LastIndexByte(email, '@')
+	if domain := email[at+1:]; !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "Invalid email domain"
+	}
+	return ""
+}
+
+const (
+	maxDisplayNameLength = 64
+	maxAvatarURLLength   = 2048
+)
+
+func validateDisplayName(name string) string {
+	if utf8.RuneCountInString(name) > maxDisplayNameLength {
+		return fmt.Sprintf("Display name must be at most %d characters", maxDisplayNameLength)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "Display name must not contain control characters"
+		}
+	}
+	return ""
+}
+
+// validateAvatarURL принимает только абсолютные http(s)-ссылки: javascript: и data:
+// в src картинки фронтенду не нужны.
+func validateAvatarURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	if len(raw) > maxAvatarURLLength {
+		return "Avatar URL is too long"
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "Avatar URL must be an http(s) link"
+	}
+	return ""
+}
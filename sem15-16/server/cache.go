@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// Cache — хранилище закэшированных значений. Срок жизни задаётся для каждого ключа.
+type Cache interface {
+	// Get возвращает значение; false — ключа нет или он истёк.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// redisCache общий для всех реплик сервера.
+type redisCache struct {
+	rdb    goredis.UniversalClient
+	prefix string
+}
+
+func newRedisCache(rdb goredis.UniversalClient) *redisCache {
+	return &redisCache{rdb: rdb, prefix: "cache:"}
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := c.rdb.Get(ctx, c.prefix+key).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.rdb.Set(ctx, c.prefix+key, value, ttl).Err()
+}
+
+func (c *redisCache) Delete(ctx context.Context, key string) error {
+	return c.rdb.Del(ctx, c.prefix+key).Err()
+}
+
+type memoryItem struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// memoryCache живёт в памяти процесса: для одной реплики и локальной разработки.
+type memoryCache struct {
+	mu    sync.RWMutex
+	items map[string]memoryItem
+}
+
+// newMemoryCache создаёт кэш и фоновую очистку истёкших ключей раз в cleanupInterval.
+func newMemoryCache(cleanupInterval time.Duration) *memoryCache {
+	c := &memoryCache{items: map[string]memoryItem{}}
+	go func() {
+		for range time.Tick(cleanupInterval) {
+			c.deleteExpired()
+		}
+	}()
+	return c
+}
+
+func (c *memoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.mu.RLock()
+	item, ok := c.items[key]
+	c.mu.RUnlock()
+	if !ok || time.Now().After(item.expiresAt) {
+		return nil, false, nil
+	}
+	return item.value, true, nil
+}
+
+func (c *memoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	c.items[key] = memoryItem{value: value, expiresAt: time.Now().Add(ttl)}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) Delete(_ context.Context, key string) error {
+	c.mu.Lock()
+	delete(c.items, key)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) deleteExpired() {
+	now := time.Now()
+	c.mu.Lock()
+	for key, item := range c.items {
+		if now.After(item.expiresAt) {
+			delete(c.items, key)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// CachedValue — значение из кэша с метаданными для HTTP-заголовков.
+type CachedValue struct {
+	Value     []byte    `json:"value"`
+	ETag      string    `json:"etag"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// cacheLoader достаёт значения из кэша, а при промахе вычисляет их через load.
+// Одновременные промахи по одному ключу в пределах процесса схлопываются
+// в один вызов load, чтобы истечение популярного ключа не вызывало лавину.
+type cacheLoader struct {
+	cache Cache
+	group singleflight.Group
+}
+
+var dataCache *cacheLoader
+
+func newCacheLoader(cache Cache) *cacheLoader {
+	return &cacheLoader{cache: cache}
+}
+
+func (l *cacheLoader) GetOrLoad(ctx context.Context, key string, ttl time.Duration, load func(ctx context.Context) ([]byte, error)) (*CachedValue, error) {
+	if cached, ok := l.lookup(ctx, key); ok {
+		return cached, nil
+	}
+
+	result, err, _ := l.group.Do(key, func() (any, error) {
+		// Пока ждали своей очереди, значение мог положить другой запрос
+		if cached, ok := l.lookup(ctx, key); ok {
+			return cached, nil
+		}
+
+		// Загрузка не должна оборваться из-за отмены запроса, который её начал:
+		// её результат ждут и другие запросы
+		ctx := context.WithoutCancel(ctx)
+		value, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(value)
+		cached := &CachedValue{
+			Value:     value,
+			ETag:      `"` + hex.EncodeToString(sum[:16]) + `"`,
+			ExpiresAt: time.Now().Add(ttl),
+		}
+		if data, err := json.Marshal(cached); err == nil {
+			if err := l.cache.Set(ctx, key, data, ttl); err != nil {
+				log.Printf("failed to cache %q: %v", key, err)
+			}
+		}
+		return cached, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*CachedValue), nil
+}
+
+// lookup при ошибке хранилища считает это промахом: кэш не должен ронять запрос.
+func (l *cacheLoader) lookup(ctx context.Context, key string) (*CachedValue, bool) {
+	data, ok, err := l.cache.Get(ctx, key)
+	if err != nil {
+		log.Printf("failed to read cache %q: %v", key, err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	var cached CachedValue
+	if err := json.Unmarshal(data, &cached); err != nil {
+		log.Printf("failed to decode cache %q: %v", key, err)
+		return nil, false
+	}
+	return &cached, true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"auth"
+	"shared/sqldb"
+)
+
+type Config struct {
+	// production скрывает от клиентов текст внутренних ошибок, development показывает его в detail
+	Environment string
+
+	// Адрес базы, пул соединений и таймаут запросов
+	DB sqldb.Config
+
+	// Политика паролей: минимальная длина и сколько классов символов
+	// (строчные, заглавные, цифры, прочие) должно встречаться
+	PasswordPolicy auth.PasswordPolicy
+
+	RedisURL string
+
+	// Кэш ответов: redis (общий для реплик) или memory, и срок жизни /api/data
+	CacheBackend string
+	DataCacheTTL time.Duration
+
+	// Тайм-ауты сессий: Idle — без запросов, Absolute — с момента входа.
+	// RememberMe* — для входа с «запомнить меня»
+	SessionIdleTimeout        time.Duration
+	SessionAbsoluteTimeout    time.Duration
+	RememberMeIdleTimeout     time.Duration
+	RememberMeAbsoluteTimeout time.Duration
+
+	// Имя сервиса в приложении-аутентификаторе
+	TOTPIssuer string
+
+	// Защита от перебора паролей: после стольких неудач подряд аккаунт или IP
+	// блокируется на LoginLockoutBase, каждая следующая неудача удваивает блокировку
+	LoginMaxAccountFailures int
+	LoginMaxIPFailures      int
+	LoginFailureWindow      time.Duration
+	LoginLockoutBase        time.Duration
+	LoginLockoutMax         time.Duration
+
+	// Лимиты частоты запросов, "<запросов>/<период>" или "off": вход и регистрация
+	// отдельно от остального API
+	RateLimitAuth RateLimit
+	RateLimitAPI  RateLimit
+	// Адреса nginx через запятую (IP или подсети), которым доверяется X-Forwarded-For
+	TrustedProxies string
+}
+
+func LoadConfig() *Config {
+	cfg := &Config{
+		Environment: getEnv("APP_ENV", "production"),
+
+		DB: sqldb.FromEnv(),
+
+		PasswordPolicy: auth.PasswordPolicy{
+			MinLength:  getEnvInt("PASSWORD_MIN_LENGTH", 8),
+			MinClasses: getEnvInt("PASSWORD_MIN_CLASSES", 2),
+		},
+
+		RedisURL: getEnv("REDIS_URL", "redis://redis:6379"),
+
+		CacheBackend: getEnv("CACHE_BACKEND", "redis"),
+		DataCacheTTL: getEnvDuration("DATA_CACHE_TTL", time.Minute),
+
+		SessionIdleTimeout:        getEnvDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+		SessionAbsoluteTimeout:    getEnvDuration("SESSION_ABSOLUTE_TIMEOUT", 12*time.Hour),
+		RememberMeIdleTimeout:     getEnvDuration("REMEMBER_ME_IDLE_TIMEOUT", 7*24*time.Hour),
+		RememberMeAbsoluteTimeout: getEnvDuration("REMEMBER_ME_ABSOLUTE_TIMEOUT", 30*24*time.Hour),
+
+		TOTPIssuer: getEnv("TOTP_ISSUER", "front2sem"),
+
+		LoginMaxAccountFailures: getEnvInt("LOGIN_MAX_ACCOUNT_FAILURES", 5),
+		LoginMaxIPFailures:      getEnvInt("LOGIN_MAX_IP_FAILURES", 20),
+		LoginFailureWindow:      getEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LoginLockoutBase:        getEnvDuration("LOGIN_LOCKOUT_BASE", 30*time.Second),
+		LoginLockoutMax:         getEnvDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+
+		RateLimitAuth:  getEnvRateLimit("RATE_LIMIT_AUTH", RateLimit{Burst: 10, Period: time.Minute}),
+		RateLimitAPI:   getEnvRateLimit("RATE_LIMIT_API", RateLimit{Burst: 120, Period: time.Minute}),
+		TrustedProxies: getEnv("TRUSTED_PROXIES", "127.0.0.1,::1"),
+	}
+	return cfg
+}
+
+func (c *Config) Production() bool {
+	return c.Environment != "development"
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+// getEnvRateLimit останавливает запуск на некорректном значении: опечатка в
+// лимите не должна молча превращаться в значение по умолчанию.
+func getEnvRateLimit(key string, defaultValue RateLimit) RateLimit {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	return limit
+}
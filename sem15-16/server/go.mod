@@ -3,10 +3,14 @@ module server
 go 1.23.5
 
 require (
+	auth v0.0.0
+	shared v0.0.0
 	github.com/gofiber/fiber/v2 v2.52.6
 	github.com/gofiber/storage/redis/v3 v3.1.3
 	github.com/lib/pq v1.10.9
-	golang.org/x/crypto v0.36.0
+	github.com/redis/go-redis/v9 v9.6.1
+	github.com/valyala/fasthttp v1.51.0
+	golang.org/x/sync v0.10.0
 )
 
 require (
@@ -18,10 +22,15 @@ require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
-	github.com/redis/go-redis/v9 v9.6.1 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.51.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
+	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 )
+
+// Общие пакеты сервисов лежат в корне репозитория
+replace (
+	auth => ../../auth
+	shared => ../../shared
+)
@@ -1,81 +1,116 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"os"
+	"log"
+	"math"
+	"strconv"
 	"time"
 
+	"auth"
+	"auth/totp"
+	"shared/clientip"
+	"shared/problem"
+	"shared/problem/fiberproblem"
+	"shared/sqldb"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/fiber/v2/middleware/session"
 	"github.com/gofiber/storage/redis/v3"
 	_ "github.com/lib/pq"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	db           *sql.DB
+	cfg          *Config
 	sessionStore *session.Store
+	users        *auth.Store
 )
 
 func main() {
-
-	dsn := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_NAME"),
-	)
+	cfg = LoadConfig()
 
 	var err error
-	db, err = sql.Open("postgres", dsn)
+	db, err = sqldb.Open(cfg.DB)
 	if err != nil {
 		panic(err)
 	}
 	defer db.Close()
 
-	if err = db.Ping(); err != nil {
+	// Таблица users общая с sem13-14, оба сервиса могут работать с одной базой
+	users = auth.NewStore(db)
+	if _, err := db.Exec(auth.Schema); err != nil {
+		panic(err)
+	}
+
+	twoFactor = totp.NewStore(db)
+	if _, err := db.Exec(totp.Schema); err != nil {
 		panic(err)
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY,
-			login VARCHAR(255) UNIQUE NOT NULL,
-			password_hash VARCHAR(255) NOT NULL
-		)`)
+	trustedProxies, err = clientip.ParseProxies(cfg.TrustedProxies)
 	if err != nil {
 		panic(err)
 	}
 
 	storage := redis.New(redis.Config{
-		URL:   "redis://redis:6379",
+		URL:   cfg.RedisURL,
 		Reset: false,
 	})
+	throttle = newLoginThrottle(storage.Conn(), cfg)
+	limiter = newRateLimiter(storage.Conn())
+	switch cfg.CacheBackend {
+	case "redis":
+		dataCache = newCacheLoader(newRedisCache(storage.Conn()))
+	case "memory":
+		dataCache = newCacheLoader(newMemoryCache(time.Minute))
+	default:
+		panic(fmt.Sprintf("unknown CACHE_BACKEND %q, expected redis or memory", cfg.CacheBackend))
+	}
 
+	sessions = newSessionIndex(storage.Conn(), max(cfg.SessionAbsoluteTimeout, cfg.RememberMeAbsoluteTimeout))
+
+	// Cookie без срока живёт до закрытия браузера; постоянную получают
+	// только сессии «запомнить меня», см. authorizeSession
 	sessionStore = session.New(session.Config{
-		Storage:        storage,
-		Expiration:     24 * time.Hour,
-		KeyLookup:      "cookie:session_id",
-		CookieHTTPOnly: true,
-		CookieSameSite: "Lax",
+		Storage:           storage,
+		Expiration:        cfg.SessionIdleTimeout,
+		KeyLookup:         "cookie:" + sessionCookieName,
+		CookieHTTPOnly:    true,
+		CookieSameSite:    "Lax",
+		CookieSessionOnly: true,
 	})
 
-	app := fiber.New()
+	app := fiber.New(fiber.Config{ErrorHandler: fiberproblem.ErrorHandler(cfg.Production())})
+	app.Use(recover.New())
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://localhost",
 		AllowHeaders:     "Origin, Content-Type, Accept",
 		AllowCredentials: true,
 	}))
-
-	app.Post("/api/register", register)
-	app.Post("/api/login", login)
-	app.Get("/api/profile", profile)
-	app.Post("/api/logout", logout)
-	app.Get("/api/data", getData)
+	app.Use(secureCookies)
+	app.Use(trackSession)
+
+	authLimit, apiLimit := rateLimit("auth", cfg.RateLimitAuth), rateLimit("api", cfg.RateLimitAPI)
+	app.Post("/api/register", authLimit, register)
+	app.Post("/api/login", authLimit, login)
+	app.Post("/api/login/2fa", authLimit, loginTwoFactor)
+	app.Get("/api/profile", apiLimit, profile)
+	app.Post("/api/logout", apiLimit, logout)
+	app.Post("/api/logout-all", apiLimit, logoutAll)
+	app.Get("/api/sessions", apiLimit, listSessions)
+	app.Delete("/api/sessions/:id", apiLimit, revokeSession)
+	app.Get("/api/data", apiLimit, getData)
+	app.Get("/api/2fa", apiLimit, twoFactorStatus)
+	app.Post("/api/2fa/setup", apiLimit, setupTwoFactor)
+	app.Post("/api/2fa/enable", apiLimit, enableTwoFactor)
+	app.Post("/api/2fa/disable", apiLimit, disableTwoFactor)
+	app.Post("/api/2fa/recovery-codes", apiLimit, regenerateRecoveryCodes)
 
 	app.Listen(":8080")
 }
@@ -88,32 +123,35 @@ func register(c *fiber.Ctx) error {
 
 	var req Request
 	if err := c.BodyParser(&req); err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return errBadRequest
 	}
 
-	var exists bool
-	err := db.QueryRow(
-		"SELECT EXISTS(SELECT 1 FROM users WHERE login = $1)",
-		req.Login,
-	).Scan(&exists)
-
-	if err != nil || exists {
-		return c.Status(fiber.StatusConflict).SendString("User already exists")
+	req.Login = normalizeLogin(req.Login)
+	errs := fieldErrors{}
+	if msg := validateLogin(req.Login); msg != "" {
+		errs["login"] = msg
 	}
+	if msg := auth.ValidatePassword(req.Password, req.Login, cfg.PasswordPolicy); msg != "" {
+		errs["password"] = msg
+	}
+	if len(errs) > 0 {
+		return validationFailed(errs)
+	}
+
+	ctx, cancel := queryContext(c.UserContext())
+	defer cancel()
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hash, err := auth.HashPassword(req.Password)
 	if err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
+		return err
 	}
 
-	_, err = db.Exec(
-		"INSERT INTO users (login, password_hash) VALUES ($1, $2)",
-		req.Login,
-		string(hashed),
-	)
-
+	err = users.Create(ctx, &auth.User{Login: req.Login, PasswordHash: hash})
+	if errors.Is(err, auth.ErrUserExists) {
+		return problem.New(fiber.StatusConflict, "user_exists", "User already exists")
+	}
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Registration failed")
+		return err
 	}
 
 	return c.SendStatus(fiber.StatusCreated)
@@ -123,89 +161,159 @@ func login(c *fiber.Ctx) error {
 	type Request struct {
 		Login    string `json:"login"`
 		Password string `json:"password"`
+		Remember bool   `json:"remember"`
 	}
 
 	var req Request
 	if err := c.BodyParser(&req); err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return errBadRequest
 	}
 
-	var (
-		userID       int
-		passwordHash string
-	)
+	// Вместо логина можно ввести email аккаунта из sem13-14; он нормализуется так же
+	req.Login = normalizeLogin(req.Login)
+	ip := clientIP(c)
 
-	err := db.QueryRow(
-		"SELECT id, password_hash FROM users WHERE login = $1",
-		req.Login,
-	).Scan(&userID, &passwordHash)
+	ctx, cancel := queryContext(c.UserContext())
+	defer cancel()
 
+	wait, err := throttle.Check(ctx, req.Login, ip)
 	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+		return err
+	}
+	if wait > 0 {
+		return tooManyAttempts(ctx, c, req.Login, ip, wait)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)); err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+	user, err := users.ByIdentifier(ctx, req.Login)
+	if errors.Is(err, auth.ErrUserNotFound) {
+		return loginFailed(ctx, c, req.Login, ip, "unknown_user")
+	}
+	if err != nil {
+		return err
+	}
+
+	if !auth.CheckPassword(user.PasswordHash, req.Password) {
+		return loginFailed(ctx, c, req.Login, ip, "bad_password")
+	}
+
+	// Адрес аккаунта из sem13-14 должен быть подтверждён, как и при входе там
+	if user.Email != "" && !user.EmailVerified() {
+		if err := throttle.Succeed(ctx, req.Login); err != nil {
+			log.Printf("failed to reset login throttle: %v", err)
+		}
+		return problem.New(fiber.StatusForbidden, "email_not_verified", "Email not verified")
+	}
+
+	enabled, _, err := twoFactor.Status(ctx, user.ID)
+	if err != nil {
+		return err
 	}
 
 	sess, err := sessionStore.Get(c)
 	if err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
+		return err
 	}
-	sess.Set("userID", userID)
-	if err := sess.Save(); err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
+
+	// Счётчик неудач сбрасывается только после второго фактора,
+	// иначе знание пароля давало бы неограниченный перебор кодов
+	if enabled {
+		if err := renewSession(c, sess); err != nil {
+			return err
+		}
+		sess.Set("pendingUserID", user.ID)
+		sess.Set("pendingUntil", time.Now().Add(mfaPendingTTL).Unix())
+		sess.Set("pendingRemember", req.Remember)
+		// Второй шаг считает попытки по тому же ключу, что и пароль: логину или email,
+		// как его ввёл пользователь
+		sess.Set("pendingLogin", req.Login)
+		if err := sess.Save(); err != nil {
+			return err
+		}
+		return c.JSON(fiber.Map{"mfa_required": true})
+	}
+
+	if err := throttle.Succeed(ctx, req.Login); err != nil {
+		log.Printf("failed to reset login throttle: %v", err)
+	}
+
+	if err := authorizeSession(c, sess, user, req.Remember); err != nil {
+		return err
 	}
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
+func tooManyAttempts(ctx context.Context, c *fiber.Ctx, login, ip string, wait time.Duration) error {
+	users.RecordLoginFailure(ctx, login, ip, "locked")
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return problem.New(fiber.StatusTooManyRequests, "login_throttled", "Too many login attempts, try again later")
+}
+
+// loginFailed учитывает неудачную попытку и отвечает одинаково для
+// неизвестного пользователя и неверного пароля.
+func loginFailed(ctx context.Context, c *fiber.Ctx, login, ip, reason string) error {
+	users.RecordLoginFailure(ctx, login, ip, reason)
+	if err := throttle.Fail(ctx, login, ip); err != nil {
+		log.Printf("failed to update login throttle: %v", err)
+	}
+	return problem.New(fiber.StatusUnauthorized, "invalid_credentials", "Invalid credentials")
+}
+
 func profile(c *fiber.Ctx) error {
 	sess, err := sessionStore.Get(c)
 	if err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
+		return err
 	}
-	userID := sess.Get("userID")
-	if userID == nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+	userID, ok := sess.Get(auth.SessionUserKey).(int)
+	if !ok {
+		return errNotLoggedIn
 	}
 
-	var login string
-	err = db.QueryRow(
-		"SELECT login FROM users WHERE id = $1",
-		userID,
-	).Scan(&login)
+	ctx, cancel := queryContext(c.UserContext())
+	defer cancel()
 
+	user, err := users.ByID(ctx, userID)
 	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+		return errNotLoggedIn
 	}
 
-	return c.JSON(fiber.Map{"login": login})
+	return c.JSON(fiber.Map{"login": user.Name(), "email": user.Email, "role": user.Role})
 }
 
 func logout(c *fiber.Ctx) error {
 	sess, err := sessionStore.Get(c)
 	if err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
+		return err
+	}
+	if userID, ok := sess.Get(auth.SessionUserKey).(int); ok {
+		if err := sessions.Remove(c.UserContext(), userID, sess.ID()); err != nil {
+			log.Printf("failed to remove session from index: %v", err)
+		}
 	}
 	if err := sess.Destroy(); err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
+		return err
 	}
 	return c.SendStatus(fiber.StatusOK)
 }
 
 func getData(c *fiber.Ctx) error {
-	const cacheFile = "/tmp/data_cache.txt"
-	const cacheDuration = time.Minute
-
-	if info, err := os.Stat(cacheFile); err == nil {
-		if time.Since(info.ModTime()) < cacheDuration {
-			data, _ := os.ReadFile(cacheFile)
-			return c.Send(data)
-		}
+	data, err := dataCache.GetOrLoad(c.UserContext(), "data", cfg.DataCacheTTL, func(ctx context.Context) ([]byte, error) {
+		return []byte(fmt.Sprintf("Data generated at: %s", time.Now().UTC())), nil
+	})
+	if err != nil {
+		return err
 	}
+	return sendCached(c, data)
+}
 
-	data := []byte(fmt.Sprintf("Data generated at: %s", time.Now().UTC()))
-	os.WriteFile(cacheFile, data, 0644)
-	return c.Send(data)
+// sendCached отдаёт закэшированное значение с ETag и Cache-Control на оставшийся
+// срок жизни; клиенту с актуальной копией отвечает 304.
+func sendCached(c *fiber.Ctx, data *CachedValue) error {
+	maxAge := max(int(time.Until(data.ExpiresAt).Seconds()), 0)
+	c.Set(fiber.HeaderETag, data.ETag)
+	c.Set(fiber.HeaderCacheControl, "private, max-age="+strconv.Itoa(maxAge))
+	if c.Get(fiber.HeaderIfNoneMatch) == data.ETag {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	return c.Send(data.Value)
 }
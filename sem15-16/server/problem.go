@@ -0,0 +1,12 @@
+package main
+
+import (
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	errBadRequest  = problem.New(fiber.StatusBadRequest, "bad_request", "Bad request")
+	errNotLoggedIn = problem.New(fiber.StatusUnauthorized, "unauthorized", "Not logged in")
+)
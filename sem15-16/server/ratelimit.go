@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth"
+	"shared/clientip"
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Ограничение частоты запросов — token bucket: в корзине до Burst токенов,
+// за Period добавляется Burst токенов, каждый запрос забирает один.
+// Корзина заводится на группу маршрутов и клиента: вошедшего пользователя
+// или, без сессии, IP-адрес. Корзины лежат в Redis и общие для всех реплик.
+
+// RateLimit — лимит группы маршрутов. Нулевой Burst выключает лимит.
+type RateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// parseRateLimit разбирает значение вида "60/1m"; "off" выключает лимит.
+func parseRateLimit(value string) (RateLimit, error) {
+	if value == "off" {
+		return RateLimit{}, nil
+	}
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected <requests>/<period>", value)
+	}
+	burst, err := strconv.Atoi(count)
+	if err != nil || burst <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: bad request count", value)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d < time.Millisecond {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: period must be at least 1ms", value)
+	}
+	return RateLimit{Burst: burst, Period: d}, nil
+}
+
+// perMilli — скорость пополнения корзины в токенах за миллисекунду.
+func (l RateLimit) perMilli() float64 {
+	return float64(l.Burst) / float64(l.Period.Milliseconds())
+}
+
+// takeTokenScript списывает токен атомарно. Время берётся у Redis, чтобы
+// часы реплик не влияли на пополнение.
+var takeTokenScript = goredis.NewScript(`
+local now = redis.call('TIME')
+local ms = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or ms
+tokens = math.min(burst, tokens + math.max(0, ms - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+    tokens = tokens - 1
+    allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ms)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return {allowed, tostring(tokens)}
+`)
+
+type rateLimiter struct {
+	rdb goredis.UniversalClient
+}
+
+var limiter *rateLimiter
+
+func newRateLimiter(rdb goredis.UniversalClient) *rateLimiter {
+	return &rateLimiter{rdb: rdb}
+}
+
+// take списывает токен и возвращает, разрешён ли запрос, и сколько токенов осталось.
+func (l *rateLimiter) take(ctx context.Context, key string, limit RateLimit) (bool, float64, error) {
+	res, err := takeTokenScript.Run(ctx, l.rdb, []string{"ratelimit:" + key},
+		limit.Burst, limit.perMilli(), limit.Period.Milliseconds(),
+	).Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(res) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	allowed, _ := res[0].(int64)
+	raw, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed == 1, tokens, nil
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimit ограничивает частоту запросов к группе маршрутов. Ставится после
+// trackSession, который кладёт ID вошедшего пользователя в Locals. Если Redis
+// недоступен, запрос пропускается: лимит не должен ронять API вместе с Redis.
+func rateLimit(group string, limit RateLimit) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if limit.Burst == 0 {
+			return c.Next()
+		}
+		key := "ip:" + clientIP(c)
+		if userID, ok := c.Locals(auth.SessionUserKey).(int); ok {
+			key = "user:" + strconv.Itoa(userID)
+		}
+
+		ctx, cancel := queryContext(c.UserContext())
+		allowed, tokens, err := limiter.take(ctx, group+":"+key, limit)
+		cancel()
+		if err != nil {
+			log.Printf("rate limit unavailable: %v", err)
+			return c.Next()
+		}
+
+		// Заголовки RateLimit-* по draft-ietf-httpapi-ratelimit-headers;
+		// Reset — через сколько секунд корзина наполнится полностью
+		rate := limit.perMilli()
+		c.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, int(limit.Period.Seconds())))
+		c.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		c.Set("RateLimit-Remaining", strconv.Itoa(int(math.Floor(tokens))))
+		c.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(time.Duration((float64(limit.Burst)-tokens)/rate)*time.Millisecond)))
+		if !allowed {
+			retryAfter := time.Duration((1-tokens)/rate) * time.Millisecond
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(max(1, ceilSeconds(retryAfter))))
+			return problem.New(fiber.StatusTooManyRequests, "rate_limited", "Too many requests")
+		}
+		return c.Next()
+	}
+}
+
+// trustedProxies — адреса nginx, которым разрешено передавать IP клиента в X-Forwarded-For.
+var trustedProxies clientip.Proxies
+
+func clientIP(c *fiber.Ctx) string {
+	var forwardedFor []string
+	for _, v := range c.Request().Header.PeekAll(fiber.HeaderXForwardedFor) {
+		forwardedFor = append(forwardedFor, string(v))
+	}
+	return trustedProxies.ClientIP(c.Context().RemoteIP(), forwardedFor)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth"
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/valyala/fasthttp"
+)
+
+const sessionCookieName = "session_id"
+
+// last_seen обновляется не чаще раза в минуту, чтобы не писать в Redis на каждый запрос.
+const lastSeenInterval = time.Minute
+
+// SessionInfo — метаданные авторизованной сессии для списка активных входов.
+// ID — случайный непрозрачный идентификатор для списка и отзыва: настоящий ID
+// сессии — это значение cookie и ключ в Redis, он не покидает cookie и служит
+// только ключом записи в индексе.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"current"`
+}
+
+// sessionIndex хранит для каждого пользователя хэш «ID сессии → метаданные».
+// Сами сессии лежат в том же Redis под своим ID (так их пишет storage/redis),
+// поэтому отзыв сессии — это удаление её ключа и записи в индексе.
+type sessionIndex struct {
+	rdb goredis.UniversalClient
+	ttl time.Duration
+}
+
+var sessions *sessionIndex
+
+// ttl — время жизни индекса, не меньше самой долгой сессии.
+func newSessionIndex(rdb goredis.UniversalClient, ttl time.Duration) *sessionIndex {
+	return &sessionIndex{rdb: rdb, ttl: ttl}
+}
+
+func userSessionsKey(userID int) string { return "user:sessions:" + strconv.Itoa(userID) }
+
+func newSessionHandle() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Add регистрирует только что авторизованную сессию sessionID. Если у info
+// ещё нет ID, ему выдаётся новый.
+func (s *sessionIndex) Add(ctx context.Context, userID int, sessionID string, info SessionInfo) error {
+	if info.ID == "" {
+		info.ID = newSessionHandle()
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, userSessionsKey(userID), sessionID, data)
+	pipe.Expire(ctx, userSessionsKey(userID), s.ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Touch обновляет last_seen и IP сессии. Сессии, которой нет в индексе
+// (например, созданной до его появления), он не заводит.
+func (s *sessionIndex) Touch(ctx context.Context, userID int, sessionID, ip string) error {
+	data, err := s.rdb.HGet(ctx, userSessionsKey(userID), sessionID).Bytes()
+	if err == goredis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var info SessionInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+	if time.Since(info.LastSeen) < lastSeenInterval && info.IP == ip {
+		return nil
+	}
+	info.LastSeen = time.Now().UTC()
+	info.IP = ip
+	return s.Add(ctx, userID, sessionID, info)
+}
+
+// List возвращает активные сессии пользователя, последние использованные первыми;
+// currentID — сессия, из которой пришёл запрос. Истёкшие сессии попутно
+// вычищаются из индекса.
+func (s *sessionIndex) List(ctx context.Context, userID int, currentID string) ([]SessionInfo, error) {
+	entries, err := s.rdb.HGetAll(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	pipe := s.rdb.Pipeline()
+	exists := map[string]*goredis.IntCmd{}
+	for id := range entries {
+		ids = append(ids, id)
+		exists[id] = pipe.Exists(ctx, id)
+	}
+	if len(ids) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	list := []SessionInfo{}
+	var stale []string
+	for _, id := range ids {
+		var info SessionInfo
+		if exists[id].Val() == 0 || json.Unmarshal([]byte(entries[id]), &info) != nil {
+			stale = append(stale, id)
+			continue
+		}
+		// В записях первых версий индекса ID совпадал с ID сессии
+		if info.ID == "" || info.ID == id {
+			info.ID = newSessionHandle()
+			if err := s.Add(ctx, userID, id, info); err != nil {
+				return nil, err
+			}
+		}
+		info.Current = id == currentID
+		list = append(list, info)
+	}
+	if len(stale) > 0 {
+		if err := s.rdb.HDel(ctx, userSessionsKey(userID), stale...).Err(); err != nil {
+			log.Printf("failed to clean up session index: %v", err)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list, nil
+}
+
+// Lookup находит ID сессии пользователя по её идентификатору из списка.
+// "" — такой сессии у него нет.
+func (s *sessionIndex) Lookup(ctx context.Context, userID int, handle string) (string, error) {
+	entries, err := s.rdb.HGetAll(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return "", err
+	}
+	for id, data := range entries {
+		var info SessionInfo
+		if json.Unmarshal([]byte(data), &info) == nil && info.ID == handle && handle != "" {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+// Revoke завершает сессию пользователя. false — такой сессии у него нет.
+func (s *sessionIndex) Revoke(ctx context.Context, userID int, sessionID string) (bool, error) {
+	removed, err := s.rdb.HDel(ctx, userSessionsKey(userID), sessionID).Result()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+	return true, s.rdb.Del(ctx, sessionID).Err()
+}
+
+// RevokeAll завершает все сессии пользователя.
+func (s *sessionIndex) RevokeAll(ctx context.Context, userID int) error {
+	ids, err := s.rdb.HKeys(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	return s.rdb.Del(ctx, append(ids, userSessionsKey(userID))...).Err()
+}
+
+// Extend продлевает хранение сессии на ttl с текущего момента.
+func (s *sessionIndex) Extend(ctx context.Context, sessionID string, ttl time.Duration) error {
+	return s.rdb.Expire(ctx, sessionID, ttl).Err()
+}
+
+// Remove убирает сессию из индекса, когда она завершается сама (logout).
+func (s *sessionIndex) Remove(ctx context.Context, userID int, sessionID string) error {
+	return s.rdb.HDel(ctx, userSessionsKey(userID), sessionID).Err()
+}
+
+// sessionPolicy — тайм-ауты сессии: Idle — сколько она живёт без запросов,
+// Absolute — сколько с момента входа, как бы активно ею ни пользовались.
+type sessionPolicy struct {
+	Idle     time.Duration
+	Absolute time.Duration
+}
+
+func sessionPolicyFor(remember bool) sessionPolicy {
+	if remember {
+		return sessionPolicy{Idle: cfg.RememberMeIdleTimeout, Absolute: cfg.RememberMeAbsoluteTimeout}
+	}
+	return sessionPolicy{Idle: cfg.SessionIdleTimeout, Absolute: cfg.SessionAbsoluteTimeout}
+}
+
+// forgetSession снимает с сессии прежнего пользователя: убирает её из индекса
+// и стирает его ID. Данные сессии (например, ожидание второго фактора) остаются.
+func forgetSession(c *fiber.Ctx, sess *session.Session) {
+	if userID, ok := sess.Get(auth.SessionUserKey).(int); ok {
+		if err := sessions.Remove(c.UserContext(), userID, sess.ID()); err != nil {
+			log.Printf("failed to remove session from index: %v", err)
+		}
+		sess.Delete(auth.SessionUserKey)
+	}
+}
+
+// renewSession выдаёт сессии новый ID при смене уровня доступа, чтобы ID,
+// подсунутый жертве заранее (session fixation), не стал авторизованным.
+// Старый ID удаляется из хранилища и индекса, данные сессии переносятся.
+func renewSession(c *fiber.Ctx, sess *session.Session) error {
+	forgetSession(c, sess)
+	return sess.Regenerate()
+}
+
+// authorizeSession закрепляет вход пользователя в сессии под новым ID,
+// сохраняет её и заносит в индекс активных сессий. Сессия «запомнить меня»
+// живёт дольше и хранится в постоянной cookie, обычная — до закрытия браузера.
+func authorizeSession(c *fiber.Ctx, sess *session.Session, user *auth.User, remember bool) error {
+	forgetSession(c, sess)
+	// Save возвращает сессию в пул, после него ID уже не прочитать
+	id, err := auth.SessionStrategy{}.Issue(sess, user)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	policy := sessionPolicyFor(remember)
+	sess.Set("authAt", now.Unix())
+	sess.Set("remember", remember)
+	sess.SetExpiry(min(policy.Idle, policy.Absolute))
+	if err := sess.Save(); err != nil {
+		return err
+	}
+	if remember {
+		c.Cookie(&fiber.Cookie{
+			Name:     sessionCookieName,
+			Value:    id,
+			Path:     "/",
+			Expires:  now.Add(policy.Absolute),
+			HTTPOnly: true,
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+	}
+
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	err = sessions.Add(c.UserContext(), user.ID, id, SessionInfo{
+		Device:    describeDevice(userAgent),
+		UserAgent: userAgent,
+		IP:        clientIP(c),
+		CreatedAt: now,
+		LastSeen:  now,
+	})
+	if err != nil {
+		log.Printf("failed to index session: %v", err)
+	}
+	return nil
+}
+
+// trackSession следит за тайм-аутами авторизованной сессии: по истечении
+// абсолютного срока завершает её, иначе продлевает на idle-тайм-аут (но не
+// дальше абсолютного срока) и обновляет last_seen в индексе.
+func trackSession(c *fiber.Ctx) error {
+	sess, err := sessionStore.Get(c)
+	if err != nil {
+		return c.Next()
+	}
+	userID, ok := sess.Get(auth.SessionUserKey).(int)
+	if !ok {
+		return c.Next()
+	}
+
+	ctx := c.UserContext()
+	authAt, _ := sess.Get("authAt").(int64)
+	remember, _ := sess.Get("remember").(bool)
+	policy := sessionPolicyFor(remember)
+	left := time.Until(time.Unix(authAt, 0).Add(policy.Absolute))
+
+	if left <= 0 {
+		if err := sessions.Remove(ctx, userID, sess.ID()); err != nil {
+			log.Printf("failed to remove session from index: %v", err)
+		}
+		if err := sess.Destroy(); err != nil {
+			log.Printf("failed to destroy expired session: %v", err)
+		}
+		return c.Next()
+	}
+
+	// По ID пользователя считает запросы rateLimit
+	c.Locals(auth.SessionUserKey, userID)
+
+	if err := sessions.Extend(ctx, sess.ID(), min(policy.Idle, left)); err != nil {
+		log.Printf("failed to extend session: %v", err)
+	}
+	if err := sessions.Touch(ctx, userID, sess.ID(), clientIP(c)); err != nil {
+		log.Printf("failed to update session last seen: %v", err)
+	}
+	return c.Next()
+}
+
+// secureCookies помечает cookie ответа как Secure, если запрос пришёл по HTTPS,
+// в том числе через прокси с X-Forwarded-Proto: https.
+func secureCookies(c *fiber.Ctx) error {
+	err := c.Next()
+	if c.Protocol() != "https" {
+		return err
+	}
+	var keys []string
+	c.Response().Header.VisitAllCookie(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	for _, key := range keys {
+		cookie := fasthttp.AcquireCookie()
+		cookie.SetKey(key)
+		if c.Response().Header.Cookie(cookie) && !cookie.Secure() {
+			cookie.SetSecure(true)
+			c.Response().Header.SetCookie(cookie)
+		}
+		fasthttp.ReleaseCookie(cookie)
+	}
+	return err
+}
+
+// describeDevice делает из User-Agent подпись вида «Firefox on Windows».
+func describeDevice(userAgent string) string {
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	system := ""
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			system = o.name
+			break
+		}
+	}
+	if system == "" {
+		return browser
+	}
+	return browser + " on " + system
+}
+
+func listSessions(c *fiber.Ctx) error {
+	sess, err := sessionStore.Get(c)
+	if err != nil {
+		return err
+	}
+	userID, _ := sess.Get(auth.SessionUserKey).(int)
+	if userID == 0 {
+		return errNotLoggedIn
+	}
+
+	list, err := sessions.List(c.UserContext(), userID, sess.ID())
+	if err != nil {
+		return err
+	}
+	return c.JSON(list)
+}
+
+// revokeSession завершает одну из сессий пользователя, в том числе текущую.
+func revokeSession(c *fiber.Ctx) error {
+	sess, err := sessionStore.Get(c)
+	if err != nil {
+		return err
+	}
+	userID, _ := sess.Get(auth.SessionUserKey).(int)
+	if userID == 0 {
+		return errNotLoggedIn
+	}
+
+	// В адресе — идентификатор из списка сессий, а не сам ID сессии
+	sessionID, err := sessions.Lookup(c.UserContext(), userID, c.Params("id"))
+	if err != nil {
+		return err
+	}
+	if sessionID == "" {
+		return problem.New(fiber.StatusNotFound, "session_not_found", "Session not found")
+	}
+	if sessionID == sess.ID() {
+		return logout(c)
+	}
+
+	ok, err := sessions.Revoke(c.UserContext(), userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return problem.New(fiber.StatusNotFound, "session_not_found", "Session not found")
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// logoutAll завершает все сессии пользователя, включая текущую.
+func logoutAll(c *fiber.Ctx) error {
+	sess, err := sessionStore.Get(c)
+	if err != nil {
+		return err
+	}
+	userID, _ := sess.Get(auth.SessionUserKey).(int)
+	if userID == 0 {
+		return errNotLoggedIn
+	}
+
+	if err := sessions.RevokeAll(c.UserContext(), userID); err != nil {
+		return err
+	}
+	if err := sess.Destroy(); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// throttlePolicy: после Threshold неудач подряд ключ блокируется на BaseDelay,
+// и каждая следующая неудача удваивает блокировку вплоть до MaxDelay.
+type throttlePolicy struct {
+	Threshold int
+	Window    time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func (p throttlePolicy) delay(failures int64) time.Duration {
+	if failures < int64(p.Threshold) {
+		return 0
+	}
+	exp := math.Min(float64(failures-int64(p.Threshold)), 30)
+	return min(time.Duration(float64(p.BaseDelay)*math.Pow(2, exp)), p.MaxDelay)
+}
+
+// loginThrottle хранит счётчики неудачных входов и блокировки в Redis,
+// поэтому они общие для всех реплик и переживают их перезапуск.
+type loginThrottle struct {
+	rdb           goredis.UniversalClient
+	accountPolicy throttlePolicy
+	ipPolicy      throttlePolicy
+}
+
+var throttle *loginThrottle
+
+func newLoginThrottle(rdb goredis.UniversalClient, cfg *Config) *loginThrottle {
+	return &loginThrottle{
+		rdb: rdb,
+		accountPolicy: throttlePolicy{
+			Threshold: cfg.LoginMaxAccountFailures,
+			Window:    cfg.LoginFailureWindow,
+			BaseDelay: cfg.LoginLockoutBase,
+			MaxDelay:  cfg.LoginLockoutMax,
+		},
+		ipPolicy: throttlePolicy{
+			Threshold: cfg.LoginMaxIPFailures,
+			Window:    cfg.LoginFailureWindow,
+			BaseDelay: cfg.LoginLockoutBase,
+			MaxDelay:  cfg.LoginLockoutMax,
+		},
+	}
+}
+
+func accountKey(login string) string { return "account:" + login }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+func failuresKey(key string) string { return "login:failures:" + key }
+func lockKey(key string) string     { return "login:lock:" + key }
+
+// Check возвращает, сколько ждать до следующей попытки входа; 0 — можно пробовать.
+// Проверяется до bcrypt, чтобы перебор не нагружал CPU.
+func (t *loginThrottle) Check(ctx context.Context, login, ip string) (time.Duration, error) {
+	pipe := t.rdb.Pipeline()
+	account := pipe.PTTL(ctx, lockKey(accountKey(login)))
+	byIP := pipe.PTTL(ctx, lockKey(ipKey(ip)))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	// PTTL возвращает отрицательное значение, если блокировки нет
+	return max(account.Val(), byIP.Val(), 0), nil
+}
+
+// Fail учитывает неудачную попытку и при необходимости блокирует аккаунт и IP.
+// Счётчик живёт Window с момента последней неудачи.
+func (t *loginThrottle) Fail(ctx context.Context, login, ip string) error {
+	for _, item := range []struct {
+		key    string
+		policy throttlePolicy
+	}{
+		{accountKey(login), t.accountPolicy},
+		{ipKey(ip), t.ipPolicy},
+	} {
+		pipe := t.rdb.TxPipeline()
+		incr := pipe.Incr(ctx, failuresKey(item.key))
+		pipe.Expire(ctx, failuresKey(item.key), item.policy.Window)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+
+		if d := item.policy.delay(incr.Val()); d > 0 {
+			if err := t.rdb.Set(ctx, lockKey(item.key), incr.Val(), d).Err(); err != nil {
+				return err
+			}
+			log.Printf("login throttled: %s locked for %s after %d failures", item.key, d, incr.Val())
+		}
+	}
+	return nil
+}
+
+// Succeed сбрасывает счётчик аккаунта. Счётчик IP не сбрасывается: с одного
+// адреса могут перебирать много аккаунтов, угадав пароль к одному из них.
+func (t *loginThrottle) Succeed(ctx context.Context, login string) error {
+	return t.rdb.Del(ctx, failuresKey(accountKey(login)), lockKey(accountKey(login))).Err()
+}
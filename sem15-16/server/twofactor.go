@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"auth"
+	"auth/totp"
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Сколько сессия ждёт кода после верного пароля.
+const mfaPendingTTL = 5 * time.Minute
+
+var twoFactor *totp.Store
+
+// sessionUserID возвращает пользователя сессии; 0 — сессия не авторизована.
+func sessionUserID(c *fiber.Ctx) (int, error) {
+	sess, err := sessionStore.Get(c)
+	if err != nil {
+		return 0, err
+	}
+	userID, _ := sess.Get(auth.SessionUserKey).(int)
+	return userID, nil
+}
+
+// checkSecondFactor проверяет TOTP-код или код восстановления. Неверные коды
+// считаются неудачными входами, как и неверные пароли. Если код не принят,
+// вызывающий возвращает полученную ошибку клиенту.
+func checkSecondFactor(ctx context.Context, c *fiber.Ctx, userID int, login, code string) (bool, error) {
+	ip := clientIP(c)
+
+	wait, err := throttle.Check(ctx, login, ip)
+	if err != nil {
+		return false, err
+	}
+	if wait > 0 {
+		return false, tooManyAttempts(ctx, c, login, ip, wait)
+	}
+
+	err = twoFactor.Verify(ctx, userID, code)
+	if errors.Is(err, totp.ErrInvalidCode) {
+		users.RecordLoginFailure(ctx, login, ip, "bad_2fa_code")
+		if err := throttle.Fail(ctx, login, ip); err != nil {
+			log.Printf("failed to update login throttle: %v", err)
+		}
+		return false, problem.New(fiber.StatusUnauthorized, "invalid_two_factor_code", "Invalid two-factor code")
+	}
+	if errors.Is(err, totp.ErrNotEnabled) {
+		return false, problem.New(fiber.StatusBadRequest, "two_factor_disabled", "Two-factor authentication is not enabled")
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := throttle.Succeed(ctx, login); err != nil {
+		log.Printf("failed to reset login throttle: %v", err)
+	}
+	return true, nil
+}
+
+// loginTwoFactor — второй шаг входа: код из приложения или код восстановления
+// для пользователя, который только что ввёл верный пароль в этой сессии.
+func loginTwoFactor(c *fiber.Ctx) error {
+	type Request struct {
+		Code string `json:"code"`
+	}
+
+	var req Request
+	if err := c.BodyParser(&req); err != nil {
+		return errBadRequest
+	}
+
+	sess, err := sessionStore.Get(c)
+	if err != nil {
+		return err
+	}
+	userID, _ := sess.Get("pendingUserID").(int)
+	until, _ := sess.Get("pendingUntil").(int64)
+	if userID == 0 || time.Now().Unix() > until {
+		return problem.New(fiber.StatusUnauthorized, "login_expired", "Login session expired, please log in again")
+	}
+
+	ctx, cancel := queryContext(c.UserContext())
+	defer cancel()
+
+	user, err := users.ByID(ctx, userID)
+	if err != nil {
+		return errNotLoggedIn
+	}
+
+	// Ключ счётчика неудач, по которому считал попытки шаг с паролем
+	login, _ := sess.Get("pendingLogin").(string)
+	if login == "" {
+		login = user.Name()
+	}
+	if ok, err := checkSecondFactor(ctx, c, userID, login, req.Code); !ok {
+		return err
+	}
+
+	remember, _ := sess.Get("pendingRemember").(bool)
+	sess.Delete("pendingUserID")
+	sess.Delete("pendingUntil")
+	sess.Delete("pendingRemember")
+	sess.Delete("pendingLogin")
+	if err := authorizeSession(c, sess, user, remember); err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func twoFactorStatus(c *fiber.Ctx) error {
+	userID, err := sessionUserID(c)
+	if err != nil {
+		return err
+	}
+	if userID == 0 {
+		return errNotLoggedIn
+	}
+
+	ctx, cancel := queryContext(c.UserContext())
+	defer cancel()
+
+	enabled, recoveryCodes, err := twoFactor.Status(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"enabled": enabled, "recovery_codes_left": recoveryCodes})
+}
+
+// setupTwoFactor выдаёт секрет и otpauth-ссылку для QR-кода. Второй фактор
+// заработает после подтверждения кодом в /api/2fa/enable.
+func setupTwoFactor(c *fiber.Ctx) error {
+	userID, err := sessionUserID(c)
+	if err != nil {
+		return err
+	}
+	if userID == 0 {
+		return errNotLoggedIn
+	}
+
+	ctx, cancel := queryContext(c.UserContext())
+	defer cancel()
+
+	user, err := users.ByID(ctx, userID)
+	if err != nil {
+		return errNotLoggedIn
+	}
+
+	secret, uri, err := twoFactor.Setup(ctx, userID, cfg.TOTPIssuer, user.Name())
+	if errors.Is(err, totp.ErrAlreadyEnabled) {
+		return problem.New(fiber.StatusConflict, "two_factor_enabled", "Two-factor authentication is already enabled")
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"secret": secret, "otpauth_uri": uri})
+}
+
+func enableTwoFactor(c *fiber.Ctx) error {
+	type Request struct {
+		Code string `json:"code"`
+	}
+
+	var req Request
+	if err := c.BodyParser(&req); err != nil {
+		return errBadRequest
+	}
+
+	userID, err := sessionUserID(c)
+	if err != nil {
+		return err
+	}
+	if userID == 0 {
+		return errNotLoggedIn
+	}
+
+	ctx, cancel := queryContext(c.UserContext())
+	defer cancel()
+
+	codes, err := twoFactor.Enable(ctx, userID, req.Code)
+	switch {
+	case errors.Is(err, totp.ErrInvalidCode):
+		return problem.New(fiber.StatusBadRequest, "invalid_two_factor_code", "Invalid two-factor code")
+	case errors.Is(err, totp.ErrNotEnrolled):
+		return problem.New(fiber.StatusBadRequest, "two_factor_setup_required", "Start two-factor setup first")
+	case errors.Is(err, totp.ErrAlreadyEnabled):
+		return problem.New(fiber.StatusConflict, "two_factor_enabled", "Two-factor authentication is already enabled")
+	case err != nil:
+		return err
+	}
+
+	return c.JSON(fiber.Map{"recovery_codes": codes})
+}
+
+// disableTwoFactor требует и пароль, и код: одной украденной сессии мало.
+func disableTwoFactor(c *fiber.Ctx) error {
+	type Request struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	var req Request
+	if err := c.BodyParser(&req); err != nil {
+		return errBadRequest
+	}
+
+	userID, err := sessionUserID(c)
+	if err != nil {
+		return err
+	}
+	if userID == 0 {
+		return errNotLoggedIn
+	}
+
+	ctx, cancel := queryContext(c.UserContext())
+	defer cancel()
+
+	user, err := users.ByID(ctx, userID)
+	if err != nil {
+		return errNotLoggedIn
+	}
+
+	if !auth.CheckPassword(user.PasswordHash, req.Password) {
+		ip := clientIP(c)
+		users.RecordLoginFailure(ctx, user.Name(), ip, "bad_password")
+		if err := throttle.Fail(ctx, user.Name(), ip); err != nil {
+			log.Printf("failed to update login throttle: %v", err)
+		}
+		return problem.New(fiber.StatusUnauthorized, "invalid_password", "Invalid password")
+	}
+
+	if ok, err := checkSecondFactor(ctx, c, userID, user.Name(), req.Code); !ok {
+		return err
+	}
+	if err := twoFactor.Disable(ctx, userID); err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// regenerateRecoveryCodes заменяет коды восстановления; старые перестают действовать.
+func regenerateRecoveryCodes(c *fiber.Ctx) error {
+	type Request struct {
+		Code string `json:"code"`
+	}
+
+	var req Request
+	if err := c.BodyParser(&req); err != nil {
+		return errBadRequest
+	}
+
+	userID, err := sessionUserID(c)
+	if err != nil {
+		return err
+	}
+	if userID == 0 {
+		return errNotLoggedIn
+	}
+
+	ctx, cancel := queryContext(c.UserContext())
+	defer cancel()
+
+	user, err := users.ByID(ctx, userID)
+	if err != nil {
+		return errNotLoggedIn
+	}
+
+	if ok, err := checkSecondFactor(ctx, c, userID, user.Name(), req.Code); !ok {
+		return err
+	}
+	codes, err := twoFactor.RegenerateRecoveryCodes(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"recovery_codes": codes})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	minLoginLength = 3
+	maxLoginLength = 32
+)
+
+// fieldErrors — ошибки проверки по полям запроса, отдаются клиенту как есть.
+type fieldErrors map[string]string
+
+func validationFailed(errs fieldErrors) *problem.Problem {
+	p := problem.New(fiber.StatusBadRequest, "validation_failed", "Validation failed")
+	p.Fields = errs
+	return p
+}
+
+// normalizeLogin убирает пробелы по краям и приводит логин к нижнему регистру,
+// чтобы Alice и alice были одним пользователем.
+func normalizeLogin(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+func validateLogin(login string) string {
+	if login == "" {
+		return "Login is required"
+	}
+	if n := utf8.RuneCountInString(login); n < minLoginLength || n > maxLoginLength {
+		return fmt.Sprintf("Login must be %d to %d characters", minLoginLength, maxLoginLength)
+	}
+	for _, r := range login {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return "Login may contain only latin letters, digits, '.', '_' and '-'"
+		}
+	}
+	return ""
+}
@@ -8,6 +8,7 @@ require (
 	github.com/lib/pq v1.10.9
 	github.com/swaggo/fiber-swagger v1.3.0
 	github.com/swaggo/swag v1.16.4
+	shared v0.0.0
 )
 
 require (
@@ -37,3 +38,6 @@ require (
 	golang.org/x/tools v0.7.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+// Общие пакеты сервисов лежат в корне репозитория
+replace shared => ../../shared
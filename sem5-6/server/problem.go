@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"os"
+	"shared/problem"
+)
+
+// production скрывает от клиентов текст внутренних ошибок; APP_ENV=development показывает его в detail
+var production = os.Getenv("APP_ENV") != "development"
+
+var (
+	errInvalidRequest  = problem.New(fiber.StatusBadRequest, "bad_request", "Invalid request")
+	errProductNotFound = problem.New(fiber.StatusNotFound, "product_not_found", "Product not found")
+)
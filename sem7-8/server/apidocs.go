@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gofiber/adaptor/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/handler"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// specDir — каталог со спецификацией, которую генерирует swag init при сборке
+// (см. go:generate ниже и Dockerfile). В репозитории она не хранится.
+//
+//go:generate swag init -g main.go -o docs --outputTypes json,yaml --parseDependencyLevel 1 --packagePrefix server,shared
+const specDir = "docs"
+
+// GraphQLRequest — тело запроса к /graphql.
+type GraphQLRequest struct {
+	Query         string                 `json:"query" example:"{ products { id name price } }"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// GraphQLResponse — ответ /graphql. Ошибки выполнения приходят в errors со статусом 200.
+type GraphQLResponse struct {
+	Data   map[string]interface{} `json:"data,omitempty"`
+	Errors []GraphQLError         `json:"errors,omitempty"`
+}
+
+type GraphQLError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// @Summary Запрос GraphQL
+// @Description Схема на языке SDL публикуется по адресу /api/swagger/schema.graphql.
+// @Tags GraphQL
+// @Accept json
+// @Produce json
+// @Param request body GraphQLRequest true "Запрос"
+// @Success 200 {object} GraphQLResponse "Результат запроса"
+// @Router /graphql [post]
+func newGraphQLHandler(schema graphql.Schema) fiber.Handler {
+	return adaptor.HTTPHandler(handler.New(&handler.Config{
+		Schema: &schema,
+		Pretty: true,
+	}))
+}
+
+// serveSpec отдаёт спецификацию, сгенерированную при сборке, для Swagger UI.
+func serveSpec(c *fiber.Ctx) error {
+	return c.SendFile(filepath.Join(specDir, "swagger.json"))
+}
+
+// serveGraphQLSchema отдаёт схему GraphQL на языке SDL. Она печатается из
+// той же схемы, что обслуживает /graphql, поэтому не расходится с кодом.
+func serveGraphQLSchema(schema graphql.Schema) fiber.Handler {
+	sdl := graphqlSDL(schema)
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, "text/plain; charset=utf-8")
+		return c.SendString(sdl)
+	}
+}
+
+// builtinScalars — скаляры из спецификации GraphQL, их в SDL не объявляют.
+var builtinScalars = map[string]bool{"Int": true, "Float": true, "String": true, "Boolean": true, "ID": true}
+
+// graphqlSDL печатает объекты, входные типы и нестандартные скаляры схемы;
+// служебные типы интроспекции пропускаются.
+func graphqlSDL(schema graphql.Schema) string {
+	var b strings.Builder
+	b.WriteString("schema {\n")
+	fmt.Fprintf(&b, "  query: %s\n", schema.QueryType().Name())
+	if m := schema.MutationType(); m != nil {
+		fmt.Fprintf(&b, "  mutation: %s\n", m.Name())
+	}
+	b.WriteString("}\n")
+
+	typeMap := schema.TypeMap()
+	names := make([]string, 0, len(typeMap))
+	for name := range typeMap {
+		if !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch t := typeMap[name].(type) {
+		case *graphql.Scalar:
+			if !builtinScalars[name] {
+				fmt.Fprintf(&b, "\nscalar %s\n", name)
+			}
+		case *graphql.Object:
+			fmt.Fprintf(&b, "\ntype %s {\n", name)
+			fields := t.Fields()
+			for _, fieldName := range sortedKeys(fields) {
+				field := fields[fieldName]
+				fmt.Fprintf(&b, "  %s%s: %s\n", fieldName, argsSDL(field.Args), field.Type)
+			}
+			b.WriteString("}\n")
+		case *graphql.InputObject:
+			fmt.Fprintf(&b, "\ninput %s {\n", name)
+			fields := t.Fields()
+			for _, fieldName := range sortedKeys(fields) {
+				fmt.Fprintf(&b, "  %s: %s\n", fieldName, fields[fieldName].Type)
+			}
+			b.WriteString("}\n")
+		}
+	}
+	return b.String()
+}
+
+func argsSDL(args []*graphql.Argument) string {
+	if len(args) == 0 {
+		return ""
+	}
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = fmt.Sprintf("%s: %s", arg.Name(), arg.Type)
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
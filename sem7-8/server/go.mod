@@ -11,6 +11,7 @@ require (
 	github.com/graphql-go/handler v0.2.4
 	github.com/lib/pq v1.10.9
 	github.com/swaggo/swag v1.16.4
+	shared v0.0.0
 )
 
 require (
@@ -42,3 +43,6 @@ require (
 	golang.org/x/tools v0.7.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+// Общие пакеты сервисов лежат в корне репозитория
+replace shared => ../../shared
@@ -1,32 +1,34 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"github.com/gofiber/adaptor/v2"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/swagger"
 	"github.com/gofiber/websocket/v2"
 	"github.com/graphql-go/graphql"
-	"github.com/graphql-go/handler"
 	"github.com/lib/pq"
 	"log"
-	_ "server/docs"
+	"shared/problem/fiberproblem"
+	"shared/sqldb"
 )
 
-type ErrorResponse struct {
-	Error string `json:"error"`
-}
-
 var db *sql.DB
 
+// dbConfig — адрес базы, пул соединений и таймаут запросов из переменных DB_*
+var dbConfig = sqldb.FromEnv()
+
 func initDB() {
 	var err error
-	db, err = sql.Open("postgres", "host=db port=5432 user=postgres password=12345678 dbname=db sslmode=disable")
+	// Open ждёт базу с повторами: контейнер Postgres может подниматься дольше сервера
+	db, err = sqldb.Open(dbConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	_, err = db.Exec(`
+	ctx, cancel := dbConfig.QueryContext(context.Background())
+	defer cancel()
+	_, err = db.ExecContext(ctx, `
 	CREATE TABLE IF NOT EXISTS products (
 		id SERIAL PRIMARY KEY,
 		name VARCHAR(255) NOT NULL,
@@ -53,12 +55,14 @@ type Product struct {
 // @Accept json
 // @Produce json
 // @Success 200 {array} Product "Успешный ответ"
-// @Failure 500 {object} ErrorResponse "Ошибка на сервере"
-// @Router /api/products [get]
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Router /products [get]
 func getProducts(c *fiber.Ctx) error {
-	rows, err := db.Query("SELECT id, name, price, description, categories FROM products")
+	ctx, cancel := dbConfig.QueryContext(c.UserContext())
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT id, name, price, description, categories FROM products")
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		return err
 	}
 	defer rows.Close()
 
@@ -66,13 +70,13 @@ func getProducts(c *fiber.Ctx) error {
 	for rows.Next() {
 		var product Product
 		if err := rows.Scan(&product.ID, &product.Name, &product.Price, &product.Description, pq.Array(&product.Categories)); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+			return err
 		}
 		products = append(products, product)
 	}
 
 	if err := rows.Err(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		return err
 	}
 
 	return c.JSON(products)
@@ -84,9 +88,10 @@ func getProducts(c *fiber.Ctx) error {
 // @Produce json
 // @Param products body []Product true "Данные продуктов"
 // @Success 200 {array} Product "Продукты успешно добавлены"
-// @Failure 400 {object} ErrorResponse "Некорректный запрос"
-// @Failure 500 {object} ErrorResponse "Ошибка на сервере"
-// @Router /api/products [post]
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 422 {object} problem.Problem "Данные нарушают ограничения таблицы"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Router /products [post]
 func addProducts(c *fiber.Ctx) error {
 	var products []Product
 
@@ -95,17 +100,19 @@ func addProducts(c *fiber.Ctx) error {
 		// Если не получилось, пробуем одиночный объект
 		var singleProduct Product
 		if err := c.BodyParser(&singleProduct); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{Error: "Invalid request"})
+			return errInvalidRequest
 		}
 		products = append(products, singleProduct)
 	}
 
 	query := "INSERT INTO products (name, price, description, categories) VALUES ($1, $2, $3, $4) RETURNING id"
 
+	ctx, cancel := dbConfig.QueryContext(c.UserContext())
+	defer cancel()
 	for i := range products {
-		err := db.QueryRow(query, products[i].Name, products[i].Price, products[i].Description, pq.Array(products[i].Categories)).Scan(&products[i].ID)
+		err := db.QueryRowContext(ctx, query, products[i].Name, products[i].Price, products[i].Description, pq.Array(products[i].Categories)).Scan(&products[i].ID)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+			return err
 		}
 	}
 
@@ -119,20 +126,29 @@ func addProducts(c *fiber.Ctx) error {
 // @Param id path int true "ID продукта"
 // @Param product body Product true "Данные продукта"
 // @Success 200 {object} map[string]string "Продукт успешно обновлен"
-// @Failure 400 {object} ErrorResponse "Некорректный запрос"
-// @Failure 500 {object} ErrorResponse "Ошибка на сервере"
-// @Router /api/products/{id} [put]
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 404 {object} problem.Problem "Продукт не найден"
+// @Failure 422 {object} problem.Problem "Данные нарушают ограничения таблицы"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Router /products/{id} [put]
 func updateProduct(c *fiber.Ctx) error {
 	id := c.Params("id")
 	var product Product
 	if err := c.BodyParser(&product); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{Error: "Invalid request"})
+		return errInvalidRequest
 	}
 
 	query := "UPDATE products SET name=$1, price=$2, description=$3, categories=$4 WHERE id=$5"
-	_, err := db.Exec(query, product.Name, product.Price, product.Description, pq.Array(product.Categories), id)
+	ctx, cancel := dbConfig.QueryContext(c.UserContext())
+	defer cancel()
+	res, err := db.ExecContext(ctx, query, product.Name, product.Price, product.Description, pq.Array(product.Categories), id)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errProductNotFound
 	}
 	return c.JSON(fiber.Map{"message": "Product updated successfully"})
 }
@@ -143,14 +159,23 @@ func updateProduct(c *fiber.Ctx) error {
 // @Produce json
 // @Param id path int true "ID продукта"
 // @Success 200 {object} map[string]string "Продукт успешно удален"
-// @Failure 500 {object} ErrorResponse "Ошибка на сервере"
-// @Router /api/products/{id} [delete]
+// @Failure 400 {object} problem.Problem "Некорректный ID"
+// @Failure 404 {object} problem.Problem "Продукт не найден"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Router /products/{id} [delete]
 func deleteProduct(c *fiber.Ctx) error {
 	id := c.Params("id")
 	query := "DELETE FROM products WHERE id=$1"
-	_, err := db.Exec(query, id)
+	ctx, cancel := dbConfig.QueryContext(c.UserContext())
+	defer cancel()
+	res, err := db.ExecContext(ctx, query, id)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errProductNotFound
 	}
 	return c.JSON(fiber.Map{"message": "Product deleted successfully"})
 }
@@ -176,7 +201,9 @@ func createSchema() graphql.Schema {
 			"products": &graphql.Field{
 				Type: graphql.NewList(productType),
 				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
-					rows, err := db.Query("SELECT id, name, price, description, categories FROM products")
+					ctx, cancel := dbConfig.QueryContext(params.Context)
+					defer cancel()
+					rows, err := db.QueryContext(ctx, "SELECT id, name, price, description, categories FROM products")
 					if err != nil {
 						return nil, err
 					}
@@ -226,46 +253,70 @@ func handleMessages() {
 	}
 }
 
-// @title TEST API
-// @version 1.0
-// @BasePath /
-func main() {
-	initDB()
-	defer db.Close()
+// @Summary Чат
+// @Description Подключение по WebSocket (через nginx — ws://localhost/ws). Клиент отправляет сообщения Message
+// @Description в формате JSON, сервер рассылает каждое сообщение всем подключённым клиентам в том же формате.
+// @Tags Chat
+// @Success 101 {object} Message "Соединение переключено на WebSocket"
+// @Failure 426 {object} problem.Problem "Запрос без Upgrade: websocket"
+// @Router /ws [get]
+func chat(c *websocket.Conn) {
+	// Регистрируем клиента
+	clients[c] = true
+	defer func() {
+		delete(clients, c)
+		c.Close()
+	}()
+	for {
+		var msg Message
+		if err := c.ReadJSON(&msg); err != nil {
+			break
+		}
+		broadcast <- msg
+	}
+}
+
+// @Summary Проверка доступности
+// @Tags Service
+// @Produce plain
+// @Success 200 {string} string "hello"
+// @Router /health [get]
+func health(c *fiber.Ctx) error {
+	return c.SendString("hello")
+}
 
-	app := fiber.New()
+// setupRoutes регистрирует все маршруты API. Каждый маршрут, кроме /swagger,
+// должен быть описан в аннотациях; это проверяет TestRoutesMatchSpec.
+func setupRoutes(app *fiber.App) {
 	app.Get("/products", getProducts)
 	app.Post("/products", addProducts)
 	app.Put("/products/:id", updateProduct)
 	app.Delete("/products/:id", deleteProduct)
-	app.Get("/health", func(c *fiber.Ctx) error { return c.SendString("hello") })
+	app.Get("/health", health)
 
 	schema := createSchema()
-	graphqlHandler := handler.New(&handler.Config{
-		Schema: &schema,
-		Pretty: true,
-	})
-	app.All("/graphql", adaptor.HTTPHandler(graphqlHandler))
-
-	go handleMessages()
+	app.Post("/graphql", newGraphQLHandler(schema))
 
-	app.Get("/ws", websocket.New(func(c *websocket.Conn) {
-		// Регистрируем клиента
-		clients[c] = true
-		defer func() {
-			delete(clients, c)
-			c.Close()
-		}()
-		for {
-			var msg Message
-			if err := c.ReadJSON(&msg); err != nil {
-				break
-			}
-			broadcast <- msg
-		}
-	}))
+	app.Get("/ws", websocket.New(chat))
 
+	app.Get("/swagger/doc.json", serveSpec)
+	app.Get("/swagger/schema.graphql", serveGraphQLSchema(schema))
 	app.Get("/swagger/*", swagger.HandlerDefault)
+}
+
+// @title TEST API
+// @version 1.0
+// @description API каталога. Через nginx все маршруты доступны с префиксом /api.
+// @description Схема GraphQL на языке SDL — /api/swagger/schema.graphql, сообщения чата /ws — модель main.Message.
+// @BasePath /api
+func main() {
+	initDB()
+	defer db.Close()
+
+	app := fiber.New(fiber.Config{ErrorHandler: fiberproblem.ErrorHandler(production)})
+	setupRoutes(app)
+
+	go handleMessages()
 
 	log.Println("Server running on port 8080")
 	log.Fatal(app.Listen(":8080"))
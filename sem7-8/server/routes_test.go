@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/swaggo/swag"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// routeParam — параметр пути в синтаксисе fiber (:id), в спецификации он пишется как {id}.
+var routeParam = regexp.MustCompile(`:(\w+)`)
+
+// TestRoutesMatchSpec сверяет зарегистрированные маршруты с аннотациями swag:
+// спецификация строится из исходников тем же парсером, что и swag init, поэтому
+// тест не зависит от того, сгенерирован ли каталог docs.
+func TestRoutesMatchSpec(t *testing.T) {
+	// Problem описан в общем модуле shared: парсер смотрит в зависимости, но только в него
+	parser := swag.New(swag.SetDebugger(log.New(io.Discard, "", 0)), swag.SetParseDependency(1), swag.SetPackagePrefix("server,shared"))
+	if err := parser.ParseAPI(".", "main.go", 100); err != nil {
+		t.Fatalf("parse annotations: %v", err)
+	}
+	documented := map[string]bool{}
+	for path, item := range parser.GetSwagger().Paths.Paths {
+		ops := map[string]bool{
+			http.MethodGet:    item.Get != nil,
+			http.MethodPost:   item.Post != nil,
+			http.MethodPut:    item.Put != nil,
+			http.MethodPatch:  item.Patch != nil,
+			http.MethodDelete: item.Delete != nil,
+		}
+		for method, ok := range ops {
+			if ok {
+				documented[method+" "+path] = true
+			}
+		}
+	}
+
+	app := fiber.New()
+	setupRoutes(app)
+	registered := map[string]bool{}
+	for _, route := range app.GetRoutes(true) {
+		// HEAD fiber добавляет к каждому GET сам; Swagger UI в спецификацию не входит
+		if route.Method == http.MethodHead || strings.HasPrefix(route.Path, "/swagger/") {
+			continue
+		}
+		registered[route.Method+" "+routeParam.ReplaceAllString(route.Path, "{$1}")] = true
+	}
+
+	for _, route := range difference(registered, documented) {
+		t.Errorf("route %s is not documented", route)
+	}
+	for _, route := range difference(documented, registered) {
+		t.Errorf("documented route %s is not registered", route)
+	}
+}
+
+func difference(a, b map[string]bool) []string {
+	var diff []string
+	for k := range a {
+		if !b[k] {
+			diff = append(diff, k)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
@@ -0,0 +1,79 @@
+// Package clientip определяет IP клиента за обратным прокси: X-Forwarded-For
+// учитывается только от доверенных адресов.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Proxies — адреса nginx, которым разрешено передавать IP клиента в X-Forwarded-For.
+type Proxies []*net.IPNet
+
+// ParseProxies разбирает список подсетей и отдельных адресов через запятую.
+func ParseProxies(value string) (Proxies, error) {
+	var nets Proxies
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", item)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", item, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (p Proxies) Trusted(ip net.IP) bool {
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP определяет IP клиента по адресу соединения и заголовкам
+// X-Forwarded-For. Заголовки учитываются, только если запрос пришёл от
+// доверенного прокси; список читается справа налево до первого недоверенного
+// адреса, так что подставленные клиентом значения слева ни на что не влияют.
+func (p Proxies) ClientIP(remote net.IP, forwardedFor []string) string {
+	if remote == nil {
+		return ""
+	}
+	if !p.Trusted(remote) {
+		return remote.String()
+	}
+	var hops []string
+	for _, header := range forwardedFor {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !p.Trusted(ip) {
+			break
+		}
+	}
+	return client.String()
+}
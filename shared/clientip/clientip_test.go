@@ -0,0 +1,70 @@
+package clientip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseProxies(t *testing.T) {
+	proxies, err := ParseProxies(" 10.0.0.0/8, 192.168.1.10 ,,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":     true,
+		"192.168.1.10": true,
+		"192.168.1.11": false,
+		"::1":          true,
+		"::2":          false,
+		"8.8.8.8":      false,
+	} {
+		if got := proxies.Trusted(net.ParseIP(ip)); got != want {
+			t.Errorf("Trusted(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	for _, value := range []string{"10.0.0.0/33", "nginx", "10.0.0"} {
+		if _, err := ParseProxies(value); err == nil {
+			t.Errorf("ParseProxies(%q): expected error", value)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		remote       string
+		forwardedFor []string
+		want         string
+	}{
+		{"no header", "10.0.0.2", nil, "10.0.0.2"},
+		{"single proxy", "10.0.0.2", []string{"203.0.113.7"}, "203.0.113.7"},
+		// Клиент сам прислал X-Forwarded-For, nginx дописал настоящий адрес справа
+		{"spoofed left value", "10.0.0.2", []string{"1.1.1.1, 203.0.113.7"}, "203.0.113.7"},
+		{"proxy chain", "10.0.0.2", []string{"203.0.113.7, 10.0.0.5"}, "203.0.113.7"},
+		{"multiple headers", "10.0.0.2", []string{"1.1.1.1", "203.0.113.7, 10.0.0.5"}, "203.0.113.7"},
+		// Недоверенный адрес останавливает разбор, даже если левее стоит доверенный
+		{"untrusted hop", "10.0.0.2", []string{"10.0.0.9, 198.51.100.1, 10.0.0.5"}, "198.51.100.1"},
+		{"garbage hop", "10.0.0.2", []string{"1.1.1.1, unknown, 10.0.0.5"}, "10.0.0.5"},
+		{"all trusted", "10.0.0.2", []string{"10.0.0.9, 10.0.0.5"}, "10.0.0.9"},
+		// Заголовок от недоверенного соединения игнорируется целиком
+		{"untrusted remote", "198.51.100.1", []string{"203.0.113.7"}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		if got := proxies.ClientIP(net.ParseIP(tt.remote), tt.forwardedFor); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if got := proxies.ClientIP(nil, []string{"203.0.113.7"}); got != "" {
+		t.Errorf("nil remote: got %q", got)
+	}
+	var none Proxies
+	if got := none.ClientIP(net.ParseIP("10.0.0.2"), []string{"203.0.113.7"}); got != "10.0.0.2" {
+		t.Errorf("no trusted proxies: got %s", got)
+	}
+}
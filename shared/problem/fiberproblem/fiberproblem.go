@@ -0,0 +1,48 @@
+// Package fiberproblem отдаёт ошибки обработчиков fiber клиенту как
+// problem.Problem. Обработчики возвращают Problem как обычную ошибку, ответ
+// пишет ErrorHandler.
+package fiberproblem
+
+import (
+	"errors"
+
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Mapping — ошибка слоя хранения или авторизации и Problem, который видит клиент.
+type Mapping struct {
+	Err     error
+	Problem *problem.Problem
+}
+
+// From переводит ошибку в Problem: свои Problem — как есть, ошибки из
+// mappings — в свои коды, ошибки fiber — по статусу, остальное — как ошибку БД.
+func From(err error, production bool, mappings ...Mapping) *problem.Problem {
+	var p *problem.Problem
+	if errors.As(err, &p) {
+		return p
+	}
+	for _, m := range mappings {
+		if errors.Is(err, m.Err) {
+			return m.Problem
+		}
+	}
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		return problem.New(fe.Code, problem.StatusCode(fe.Code), fe.Message)
+	}
+	return problem.FromDB(err, production)
+}
+
+// ErrorHandler возвращает обработчик ошибок приложения: любая ошибка обработчика
+// или самого fiber (нет маршрута, слишком большое тело) уходит клиенту как Problem.
+func ErrorHandler(production bool, mappings ...Mapping) fiber.ErrorHandler {
+	return func(c *fiber.Ctx, err error) error {
+		// Problem из переменных сервиса общие для всех запросов, Instance пишем в копию
+		p := *From(err, production, mappings...)
+		p.Instance = c.Path()
+		return c.Status(p.Status).JSON(p, problem.ContentType)
+	}
+}
@@ -0,0 +1,70 @@
+package fiberproblem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var errMissing = errors.New("missing")
+
+func TestFrom(t *testing.T) {
+	mappings := []Mapping{{errMissing, problem.New(fiber.StatusNotFound, "thing_not_found", "Thing not found")}}
+	own := problem.New(fiber.StatusBadRequest, "bad_request", "Bad body")
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"problem", own, fiber.StatusBadRequest, "bad_request"},
+		{"wrapped problem", fmt.Errorf("decode: %w", own), fiber.StatusBadRequest, "bad_request"},
+		{"mapping", fmt.Errorf("get: %w", errMissing), fiber.StatusNotFound, "thing_not_found"},
+		{"fiber error", fiber.ErrRequestEntityTooLarge, fiber.StatusRequestEntityTooLarge, "request_entity_too_large"},
+		{"other", errors.New("boom"), fiber.StatusInternalServerError, "internal_error"},
+	}
+	for _, tt := range tests {
+		p := From(tt.err, true, mappings...)
+		if p.Status != tt.status || p.Code != tt.code {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, p.Status, p.Code, tt.status, tt.code)
+		}
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	shared := problem.New(fiber.StatusBadRequest, "bad_request", "Bad body")
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler(true)})
+	app.Get("/bad", func(c *fiber.Ctx) error { return shared })
+	app.Get("/boom", func(c *fiber.Ctx) error { return errors.New(`relation "products" does not exist`) })
+
+	for path, want := range map[string]int{"/bad": 400, "/boom": 500, "/missing": 404} {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want || resp.Header.Get("Content-Type") != problem.ContentType {
+			t.Errorf("%s: got %d %q", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		var p problem.Problem
+		if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if p.Instance != path || p.Status != want {
+			t.Errorf("%s: got %+v", path, p)
+		}
+		if path == "/boom" && p.Detail != "" {
+			t.Errorf("production: internal detail %q", p.Detail)
+		}
+	}
+	// Instance пишется в копию, общий Problem не меняется
+	if shared.Instance != "" {
+		t.Errorf("shared problem modified: %+v", shared)
+	}
+}
@@ -0,0 +1,121 @@
+// Package problem — ошибки API в формате RFC 7807 (application/problem+json)
+// и перевод в них ошибок Postgres. Драйвер не важен: и lib/pq, и pgx отдают
+// SQLSTATE через метод SQLState. Ответ клиенту на fiber пишет fiberproblem,
+// сервис на gin отвечает сам.
+package problem
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const ContentType = "application/problem+json"
+
+// Problem — ошибка API. Type всегда about:blank, поэтому Title — текст
+// HTTP-статуса. Клиенты различают ошибки по Code, Detail — сообщение для человека.
+type Problem struct {
+	Type     string `json:"type" example:"about:blank"`
+	Title    string `json:"title" example:"Not Found"`
+	Status   int    `json:"status" example:"404"`
+	Code     string `json:"code" example:"not_found"`
+	Detail   string `json:"detail,omitempty" example:"Resource not found"`
+	Instance string `json:"instance,omitempty" example:"/products/42"`
+	// Ошибки проверки по полям запроса
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func New(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%d %s: %s", p.Status, p.Code, p.Detail)
+}
+
+// StatusCode — код ошибки по умолчанию: текст статуса в snake_case.
+func StatusCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// Internal скрывает текст ошибки в production: он может содержать SQL, имена
+// таблиц и другие подробности, полезные только при отладке.
+func Internal(err error, production bool) *Problem {
+	log.Printf("internal error: %v", err)
+	p := New(http.StatusInternalServerError, "internal_error", "")
+	if !production {
+		p.Detail = err.Error()
+	}
+	return p
+}
+
+type sqlStateError interface {
+	error
+	SQLState() string
+}
+
+type dbMapping struct {
+	status int
+	code   string
+	detail string
+}
+
+// dbProblems — ошибки Postgres, вызванные данными запроса, а не сбоем сервера.
+var dbProblems = map[string]dbMapping{
+	"23505": {http.StatusConflict, "already_exists", "Resource already exists"},
+	"23503": {http.StatusConflict, "reference_violation", "Resource is referenced or refers to a missing resource"},
+	"23514": {http.StatusUnprocessableEntity, "constraint_violation", "Value violates a constraint"},
+	"23502": {http.StatusUnprocessableEntity, "constraint_violation", "Required value is missing"},
+	"22001": {http.StatusUnprocessableEntity, "constraint_violation", "Value is too long"},
+	"22003": {http.StatusUnprocessableEntity, "constraint_violation", "Value is out of range"},
+	"22P02": {http.StatusBadRequest, "bad_request", "Invalid value"},
+}
+
+// queryCanceled — SQLSTATE запроса, прерванного statement_timeout.
+const queryCanceled = "57014"
+
+// FromDB переводит ошибку БД в Problem: отсутствующая строка — 404, нарушения
+// ограничений — 400, 409 или 422, таймаут — 503, остальное — 500. Вне
+// production к detail дописывается сообщение драйвера с именем ограничения.
+func FromDB(err error, production bool) *Problem {
+	// pgx.ErrNoRows оборачивает sql.ErrNoRows
+	if errors.Is(err, sql.ErrNoRows) {
+		return New(http.StatusNotFound, "not_found", "Resource not found")
+	}
+
+	var stateErr sqlStateError
+	if errors.As(err, &stateErr) {
+		if m, ok := dbProblems[stateErr.SQLState()]; ok {
+			p := New(m.status, m.code, m.detail)
+			if !production {
+				p.Detail += " (" + stateErr.Error() + ")"
+			}
+			return p
+		}
+	}
+
+	if isTimeout(err) || (stateErr != nil && stateErr.SQLState() == queryCanceled) {
+		log.Printf("database timeout: %v", err)
+		return New(http.StatusServiceUnavailable, "timeout", "Database did not respond in time")
+	}
+	return Internal(err, production)
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,89 @@
+package problem
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// pgError повторяет ошибку драйвера: и lib/pq, и pgx отдают SQLSTATE через SQLState.
+type pgError struct{ code, message string }
+
+func (e *pgError) Error() string    { return e.message }
+func (e *pgError) SQLState() string { return e.code }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestFromDB(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"no rows", sql.ErrNoRows, http.StatusNotFound, "not_found"},
+		{"wrapped no rows", fmt.Errorf("get product: %w", sql.ErrNoRows), http.StatusNotFound, "not_found"},
+		{"unique", &pgError{"23505", "duplicate key"}, http.StatusConflict, "already_exists"},
+		{"foreign key", &pgError{"23503", "violates foreign key"}, http.StatusConflict, "reference_violation"},
+		{"check", &pgError{"23514", "violates check"}, http.StatusUnprocessableEntity, "constraint_violation"},
+		{"not null", &pgError{"23502", "null value"}, http.StatusUnprocessableEntity, "constraint_violation"},
+		{"too long", &pgError{"22001", "value too long"}, http.StatusUnprocessableEntity, "constraint_violation"},
+		{"out of range", &pgError{"22003", "out of range"}, http.StatusUnprocessableEntity, "constraint_violation"},
+		{"bad syntax", &pgError{"22P02", "invalid input syntax"}, http.StatusBadRequest, "bad_request"},
+		{"wrapped unique", fmt.Errorf("insert: %w", &pgError{"23505", "duplicate key"}), http.StatusConflict, "already_exists"},
+		{"statement timeout", &pgError{"57014", "canceling statement"}, http.StatusServiceUnavailable, "timeout"},
+		{"deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), http.StatusServiceUnavailable, "timeout"},
+		{"network timeout", timeoutError{}, http.StatusServiceUnavailable, "timeout"},
+		{"syntax error", &pgError{"42601", "syntax error"}, http.StatusInternalServerError, "internal_error"},
+		{"unknown", errors.New("connection refused"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, tt := range tests {
+		p := FromDB(tt.err, true)
+		if p.Status != tt.status || p.Code != tt.code {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, p.Status, p.Code, tt.status, tt.code)
+		}
+		if p.Title != http.StatusText(tt.status) || p.Type != "about:blank" {
+			t.Errorf("%s: got type %q title %q", tt.name, p.Type, p.Title)
+		}
+	}
+}
+
+func TestFromDBDetail(t *testing.T) {
+	err := &pgError{"23505", `duplicate key value violates unique constraint "products_sku_key"`}
+
+	// В production имя ограничения и текст драйвера клиенту не показываются
+	if p := FromDB(err, true); p.Detail != "Resource already exists" {
+		t.Errorf("production: detail %q", p.Detail)
+	}
+	if p := FromDB(err, false); !strings.Contains(p.Detail, "products_sku_key") {
+		t.Errorf("development: detail %q, want driver message", p.Detail)
+	}
+
+	internal := errors.New(`relation "products" does not exist`)
+	if p := FromDB(internal, true); p.Detail != "" {
+		t.Errorf("production: internal detail %q", p.Detail)
+	}
+	if p := FromDB(internal, false); p.Detail != internal.Error() {
+		t.Errorf("development: internal detail %q", p.Detail)
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusNotFound:              "not_found",
+		http.StatusRequestEntityTooLarge: "request_entity_too_large",
+		http.StatusTooManyRequests:       "too_many_requests",
+	} {
+		if got := StatusCode(status); got != want {
+			t.Errorf("StatusCode(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package sqldb — подключение сервисов к Postgres через database/sql: адрес и
+// настройки пула из переменных окружения, ожидание базы при запуске и таймаут
+// запросов. Драйвер postgres (lib/pq) регистрирует сам сервис. task10 работает
+// через pgx и берёт отсюда всё, кроме Open.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// Сколько раз пинговать базу при запуске, пока контейнер с ней поднимается
+	ConnectAttempts int
+
+	// Максимальное время выполнения запросов к БД в рамках одного HTTP-запроса
+	QueryTimeout time.Duration
+}
+
+// FromEnv читает DB_* из окружения; значения по умолчанию подходят для
+// docker-compose проектов репозитория.
+func FromEnv() Config {
+	return Config{
+		Host:     getEnv("DB_HOST", "db"),
+		Port:     getEnv("DB_PORT", "5432"),
+		User:     getEnv("DB_USER", "postgres"),
+		Password: getEnv("DB_PASSWORD", "12345678"),
+		Name:     getEnv("DB_NAME", "db"),
+
+		MaxOpenConns:    getEnvInt("DB_MAX_OPEN_CONNS", 20),
+		MaxIdleConns:    getEnvInt("DB_MAX_IDLE_CONNS", 5),
+		ConnMaxLifetime: getEnvDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+		ConnMaxIdleTime: getEnvDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute),
+		ConnectAttempts: getEnvInt("DB_CONNECT_ATTEMPTS", 10),
+
+		QueryTimeout: getEnvDuration("DB_QUERY_TIMEOUT", 5*time.Second),
+	}
+}
+
+func (c Config) DSN() string {
+	return fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		c.Host, c.Port, c.User, c.Password, c.Name,
+	)
+}
+
+// Open настраивает пул и ждёт, пока база ответит.
+func Open(cfg Config) (*sql.DB, error) {
+	db, err := sql.Open("postgres", cfg.DSN())
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	if err := Wait(db.PingContext, cfg.ConnectAttempts); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Wait вызывает ping с экспоненциальной задержкой, пока база не станет доступна
+// или не закончатся попытки. ping получает контекст с таймаутом одной попытки.
+func Wait(ping func(ctx context.Context) error, attempts int) error {
+	backoff := 500 * time.Millisecond
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = ping(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			break
+		}
+		log.Printf("database is not ready (attempt %d/%d): %v; retrying in %s", attempt, attempts, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 15*time.Second)
+	}
+	return err
+}
+
+// QueryContext ограничивает время запросов к БД в рамках одного HTTP-запроса.
+func (c Config) QueryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, c.QueryTimeout)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
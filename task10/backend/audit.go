@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"time"
+
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// Операции, которые попадают в журнал product_audit.
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	auditImport  = "import"
+	auditRevert  = "revert"
+)
+
+var errAuditVersionNotFound = errors.New("audit version not found")
+
+// ProductSnapshot — состояние продукта после изменения. По нему строится diff
+// и выполняется откат к версии.
+type ProductSnapshot struct {
+	SKU         string   `json:"sku"`
+	Name        string   `json:"name"`
+	Price       float64  `json:"price"`
+	Description string   `json:"description"`
+	Categories  []string `json:"categories"`
+	Deleted     bool     `json:"deleted"`
+}
+
+// Порядок полей в diff.
+var snapshotFields = []string{"sku", "name", "price", "description", "categories", "deleted"}
+
+type FieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old" swaggertype:"object"`
+	New   json.RawMessage `json:"new" swaggertype:"object"`
+}
+
+type AuditEntry struct {
+	Version    int             `json:"version"`
+	Operation  string          `json:"operation"`
+	Actor      string          `json:"actor"`
+	ChangedAt  time.Time       `json:"changed_at"`
+	Changes    []FieldChange   `json:"changes"`
+	Snapshot   ProductSnapshot `json:"snapshot"`
+	RevertedTo *int            `json:"reverted_to,omitempty"`
+}
+
+func snapshotOf(p Product, deleted bool) *ProductSnapshot {
+	categories := p.Categories
+	if categories == nil {
+		categories = []string{}
+	}
+	return &ProductSnapshot{
+		SKU:         p.SKU,
+		Name:        p.Name,
+		Price:       storedPrice(p.Price),
+		Description: p.Description,
+		Categories:  categories,
+		Deleted:     deleted,
+	}
+}
+
+// storedPrice — цена в том виде, в каком её сохранит столбец DECIMAL(10, 2):
+// pgx передаёт float64 кратчайшей десятичной записью, Postgres округляет её до
+// двух знаков, половину — от нуля. math.Round(p*100) здесь не подходит: 1.005
+// в двоичном виде чуть меньше и округлилось бы вниз.
+func storedPrice(p float64) float64 {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(p, 'f', -1, 64))
+	if !ok {
+		return p
+	}
+	r.Mul(r, big.NewRat(100, 1))
+	cents, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	// Остаток не меньше половины цента — округляем от нуля
+	if new(big.Int).Lsh(rem.Abs(rem), 1).Cmp(r.Denom()) >= 0 {
+		cents.Add(cents, big.NewInt(int64(r.Num().Sign())))
+	}
+	price, _ := new(big.Rat).SetFrac(cents, big.NewInt(100)).Float64()
+	return price
+}
+
+func snapshotFieldValues(s *ProductSnapshot) map[string]json.RawMessage {
+	values := map[string]json.RawMessage{}
+	if s == nil {
+		return values
+	}
+	data, _ := json.Marshal(s)
+	json.Unmarshal(data, &values)
+	return values
+}
+
+// diffSnapshots возвращает изменившиеся поля; before == nil означает создание продукта.
+func diffSnapshots(before, after *ProductSnapshot) []FieldChange {
+	oldValues, newValues := snapshotFieldValues(before), snapshotFieldValues(after)
+	changes := []FieldChange{}
+	for _, field := range snapshotFields {
+		oldValue, newValue := oldValues[field], newValues[field]
+		if bytes.Equal(oldValue, newValue) {
+			continue
+		}
+		if oldValue == nil {
+			oldValue = json.RawMessage("null")
+		}
+		changes = append(changes, FieldChange{Field: field, Old: oldValue, New: newValue})
+	}
+	return changes
+}
+
+// recordAudit дописывает версию в журнал в той же транзакции, что и само изменение.
+// Строка продукта к этому моменту заблокирована, поэтому номер версии не гоняется.
+func recordAudit(ctx context.Context, tx pgx.Tx, productID int, operation string, before, after *ProductSnapshot, revertedTo *int) error {
+	_, err := tx.Exec(ctx, stmtInsertAudit,
+		productID, operation, actorFromContext(ctx), diffSnapshots(before, after), after, revertedTo,
+	)
+	return err
+}
+
+// copyAuditCreates пишет записи о создании для пачки, вставленной через COPY.
+func copyAuditCreates(ctx context.Context, tx pgx.Tx, products []Product) error {
+	actor := actorFromContext(ctx)
+	_, err := tx.CopyFrom(ctx, pgx.Identifier{"product_audit"},
+		[]string{"product_id", "version", "operation", "actor", "changes", "snapshot"},
+		pgx.CopyFromSlice(len(products), func(i int) ([]any, error) {
+			after := snapshotOf(products[i], false)
+			return []any{products[i].ID, 1, auditCreate, actor, diffSnapshots(nil, after), after}, nil
+		}),
+	)
+	return err
+}
+
+// lockProduct читает текущее состояние продукта (в том числе из корзины)
+// и блокирует строку до конца транзакции.
+func lockProduct(ctx context.Context, tx pgx.Tx, id int) (*ProductSnapshot, error) {
+	var s ProductSnapshot
+	err := tx.QueryRow(ctx, stmtLockProduct, id).Scan(&s.SKU, &s.Name, &s.Price, &s.Description, &s.Categories, &s.Deleted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errProductNotFound
+	}
+	if s.Categories == nil {
+		s.Categories = []string{}
+	}
+	return &s, err
+}
+
+func productHistory(ctx context.Context, id int) ([]AuditEntry, error) {
+	rows, err := db.Query(ctx, stmtSelectAudit, id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (AuditEntry, error) {
+		var e AuditEntry
+		err := row.Scan(&e.Version, &e.Operation, &e.Actor, &e.ChangedAt, &e.Changes, &e.Snapshot, &e.RevertedTo)
+		return e, err
+	})
+}
+
+// revertProductToVersion возвращает продукт к состоянию из указанной версии журнала,
+// включая нахождение в корзине. Откат сам записывается новой версией.
+func revertProductToVersion(ctx context.Context, id, version int) error {
+	return productTx(ctx, func(tx pgx.Tx) error {
+		var target ProductSnapshot
+		err := tx.QueryRow(ctx, "SELECT snapshot FROM product_audit WHERE product_id = $1 AND version = $2", id, version).Scan(&target)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errAuditVersionNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		before, err := lockProduct(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		// Снимки, записанные до округления цены в журнале, могут хранить лишние знаки
+		target.Price = storedPrice(target.Price)
+		_, err = tx.Exec(ctx, stmtRevertProduct, target.SKU, target.Name, target.Price, target.Description, target.Categories, target.Deleted, id)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, id, auditRevert, before, &target, &version)
+	})
+}
+
+// @Summary История изменений продукта
+// @Description Версии из журнала аудита, новые первыми. Доступна и для продуктов в корзине.
+// @Tags Audit
+// @Produce json
+// @Param id path int true "ID продукта"
+// @Success 200 {array} AuditEntry "Журнал изменений"
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 404 {object} problem.Problem "История не найдена"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Security BearerAuth
+// @Router /products/{id}/history [get]
+func getProductHistory(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return errInvalidProductID
+	}
+
+	ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+	defer cancel()
+
+	history, err := productHistory(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		return problem.New(fiber.StatusNotFound, "history_not_found", "History not found")
+	}
+	return c.JSON(history)
+}
+
+// @Summary Откатить продукт к версии
+// @Tags Audit
+// @Produce json
+// @Param id path int true "ID продукта"
+// @Param version path int true "Номер версии из истории"
+// @Success 200 {object} map[string]string "Продукт восстановлен из версии"
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 404 {object} problem.Problem "Продукт или версия не найдены"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Security BearerAuth
+// @Router /products/{id}/revert/{version} [post]
+func revertProduct(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return errInvalidProductID
+	}
+	version, err := c.ParamsInt("version")
+	if err != nil {
+		return problem.New(fiber.StatusBadRequest, "invalid_version", "Invalid version")
+	}
+
+	ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+	defer cancel()
+
+	err = revertProductToVersion(ctx, id, version)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"message": "Product reverted successfully"})
+}
+
+type actorKey struct{}
+
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorFromContext возвращает автора изменения для журнала; фоновые задачи пишутся как system.
+func actorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+	return "system"
+}
+
+func anonymousActor(ip string) string {
+	return "anonymous@" + ip
+}
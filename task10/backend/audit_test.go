@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+func changedFields(changes []FieldChange) map[string]FieldChange {
+	byField := map[string]FieldChange{}
+	for _, c := range changes {
+		byField[c.Field] = c
+	}
+	return byField
+}
+
+func TestDiffSnapshotsCreate(t *testing.T) {
+	after := snapshotOf(Product{SKU: "A-1", Name: "Lamp", Price: 10}, false)
+	changes := diffSnapshots(nil, after)
+
+	// Новый продукт: в diff попадают все поля, старое значение — null
+	if len(changes) != len(snapshotFields) {
+		t.Fatalf("got %d changes, want %d: %+v", len(changes), len(snapshotFields), changes)
+	}
+	for i, c := range changes {
+		if c.Field != snapshotFields[i] {
+			t.Errorf("change %d is %q, want fields in order %v", i, c.Field, snapshotFields)
+		}
+		if string(c.Old) != "null" {
+			t.Errorf("%s: old = %s, want null", c.Field, c.Old)
+		}
+	}
+	byField := changedFields(changes)
+	if got := string(byField["categories"].New); got != "[]" {
+		t.Errorf("categories: new = %s, want []", got)
+	}
+	if got := string(byField["price"].New); got != "10" {
+		t.Errorf("price: new = %s, want 10", got)
+	}
+}
+
+func TestDiffSnapshotsUpdate(t *testing.T) {
+	before := snapshotOf(Product{SKU: "A-1", Name: "Lamp", Price: 10, Categories: []string{"light"}}, false)
+	after := snapshotOf(Product{SKU: "A-1", Name: "Desk lamp", Price: 10, Categories: []string{"light", "desk"}}, false)
+
+	byField := changedFields(diffSnapshots(before, after))
+	if len(byField) != 2 {
+		t.Fatalf("got changes %v, want only name and categories", byField)
+	}
+	if c := byField["name"]; string(c.Old) != `"Lamp"` || string(c.New) != `"Desk lamp"` {
+		t.Errorf("name: %s -> %s", c.Old, c.New)
+	}
+	if c := byField["categories"]; string(c.Old) != `["light"]` || string(c.New) != `["light","desk"]` {
+		t.Errorf("categories: %s -> %s", c.Old, c.New)
+	}
+}
+
+func TestDiffSnapshotsDelete(t *testing.T) {
+	p := Product{SKU: "A-1", Name: "Lamp", Price: 10}
+	changes := diffSnapshots(snapshotOf(p, false), snapshotOf(p, true))
+	if len(changes) != 1 || changes[0].Field != "deleted" || string(changes[0].New) != "true" {
+		t.Fatalf("got %+v, want only deleted: false -> true", changes)
+	}
+}
+
+func TestDiffSnapshotsUnchanged(t *testing.T) {
+	// nil и пустой список категорий — одно и то же состояние
+	before := snapshotOf(Product{SKU: "A-1", Name: "Lamp", Price: 10}, false)
+	after := snapshotOf(Product{SKU: "A-1", Name: "Lamp", Price: 10, Categories: []string{}}, false)
+	if changes := diffSnapshots(before, after); len(changes) != 0 {
+		t.Fatalf("got %+v, want no changes", changes)
+	}
+}
+
+func TestStoredPrice(t *testing.T) {
+	for price, want := range map[float64]float64{
+		10:     10,
+		12.5:   12.5,
+		1.005:  1.01,
+		2.675:  2.68,
+		0.125:  0.13,
+		1.004:  1,
+		-1.005: -1.01,
+		99.999: 100,
+	} {
+		if got := storedPrice(price); got != want {
+			t.Errorf("storedPrice(%v) = %v, want %v", price, got, want)
+		}
+	}
+}
+
+func TestSnapshotPriceMatchesColumn(t *testing.T) {
+	before := snapshotOf(Product{SKU: "A-1", Name: "Lamp", Price: 1.01}, false)
+	// Цена из запроса отличается, но в DECIMAL(10, 2) сохранится та же
+	after := snapshotOf(Product{SKU: "A-1", Name: "Lamp", Price: 1.005}, false)
+	if after.Price != 1.01 {
+		t.Fatalf("snapshot price = %v, want 1.01", after.Price)
+	}
+	if changes := diffSnapshots(before, after); len(changes) != 0 {
+		t.Fatalf("got %+v, want no changes", changes)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Роли совпадают с ролями сервиса авторизации sem13-14, который выдаёт токены
+// с claim "role". Каждая следующая роль включает права предыдущей.
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+var roleLevels = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleAdmin:  3,
+}
+
+var (
+	errUnauthorized = errors.New("authentication required")
+	errForbidden    = errors.New("insufficient role")
+)
+
+// Principal — пользователь, от имени которого выполняется запрос.
+type Principal struct {
+	UserID int
+	Role   string
+}
+
+type principalKey struct{}
+
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// parseAccessToken проверяет заголовок Authorization. Пустой заголовок —
+// анонимный запрос, для него возвращается nil без ошибки.
+func parseAccessToken(ctx context.Context, header string) (*Principal, error) {
+	if header == "" {
+		return nil, nil
+	}
+	tokenString, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return nil, errors.New("authorization scheme not supported")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := accessTokenKeys.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method.Alg() != key.alg {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return key.key, nil
+	},
+		jwt.WithValidMethods([]string{"EdDSA", "RS256"}),
+		jwt.WithIssuer(cfg.JWTIssuer),
+		jwt.WithAudience(cfg.JWTAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims["typ"] != "access" {
+		return nil, errors.New("not an access token")
+	}
+
+	sub, _ := claims["sub"].(string)
+	userID, err := strconv.Atoi(sub)
+	if err != nil {
+		return nil, errors.New("invalid sub claim")
+	}
+	role, _ := claims["role"].(string)
+	if _, ok := roleLevels[role]; !ok {
+		return nil, fmt.Errorf("unknown role %q", role)
+	}
+	return &Principal{UserID: userID, Role: role}, nil
+}
+
+// authenticate кладёт в контекст пользователя из токена и автора изменений для журнала.
+func authenticate(ctx context.Context, authHeader, clientIP string) (context.Context, error) {
+	principal, err := parseAccessToken(ctx, authHeader)
+	if err != nil {
+		return ctx, err
+	}
+	if principal == nil {
+		return withActor(ctx, anonymousActor(clientIP)), nil
+	}
+	ctx = context.WithValue(ctx, principalKey{}, principal)
+	return withActor(ctx, fmt.Sprintf("user:%d", principal.UserID)), nil
+}
+
+// checkRole проверяет, что у пользователя из контекста роль не ниже указанной.
+func checkRole(ctx context.Context, role string) error {
+	principal := principalFromContext(ctx)
+	if principal == nil {
+		return errUnauthorized
+	}
+	if roleLevels[principal.Role] < roleLevels[role] {
+		return errForbidden
+	}
+	return nil
+}
+
+// authMiddleware разбирает токен, если он есть. Анонимные запросы пропускаются,
+// права на конкретные маршруты проверяет requireRole.
+func authMiddleware(c *fiber.Ctx) error {
+	ctx, err := authenticate(c.UserContext(), c.Get(fiber.HeaderAuthorization), clientIP(c))
+	if err != nil {
+		return errInvalidToken
+	}
+	c.SetUserContext(ctx)
+	return c.Next()
+}
+
+func requireRole(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// errUnauthorized и errForbidden обработчик ошибок приложения переводит в 401 и 403
+		if err := checkRole(c.UserContext(), role); err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
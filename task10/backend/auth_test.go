@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// withTestKeys подставляет ключи вместо JWKS сервиса авторизации. Кэш помечен
+// свежим, чтобы проверка токена не ходила в сеть.
+func withTestKeys(t *testing.T, keys map[string]verificationKey) {
+	t.Helper()
+	prevCfg, prevKeys := cfg, accessTokenKeys
+	t.Cleanup(func() { cfg, accessTokenKeys = prevCfg, prevKeys })
+
+	cfg = &Config{JWTIssuer: "auth-service", JWTAudience: "front2sem"}
+	accessTokenKeys = newJWKSCache("http://127.0.0.1:0/jwks.json", time.Hour)
+	accessTokenKeys.keys = keys
+	accessTokenKeys.fetchedAt = time.Now()
+}
+
+func testClaims(typ string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":  "auth-service",
+		"aud":  "front2sem",
+		"sub":  "42",
+		"role": roleEditor,
+		"typ":  typ,
+		"iat":  now.Unix(),
+		"exp":  now.Add(time.Minute).Unix(),
+	}
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.MapClaims, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + s
+}
+
+func TestParseAccessToken(t *testing.T) {
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTestKeys(t, map[string]verificationKey{
+		"ed":  {alg: "EdDSA", key: edPublic},
+		"rsa": {alg: "RS256", key: &rsaPrivate.PublicKey},
+	})
+	ctx := context.Background()
+
+	for name, header := range map[string]string{
+		"EdDSA": signTestToken(t, jwt.SigningMethodEdDSA, "ed", testClaims("access"), edPrivate),
+		"RS256": signTestToken(t, jwt.SigningMethodRS256, "rsa", testClaims("access"), rsaPrivate),
+	} {
+		p, err := parseAccessToken(ctx, header)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if p.UserID != 42 || p.Role != roleEditor {
+			t.Errorf("%s: got %+v", name, p)
+		}
+	}
+
+	wrongAudience := testClaims("access")
+	wrongAudience["aud"] = "other-service"
+	unknownRole := testClaims("access")
+	unknownRole["role"] = "root"
+	noExpiry := testClaims("access")
+	delete(noExpiry, "exp")
+
+	rejected := map[string]string{
+		"refresh token":  signTestToken(t, jwt.SigningMethodEdDSA, "ed", testClaims("refresh"), edPrivate),
+		"mfa token":      signTestToken(t, jwt.SigningMethodEdDSA, "ed", testClaims("mfa"), edPrivate),
+		"no typ":         signTestToken(t, jwt.SigningMethodEdDSA, "ed", testClaims(""), edPrivate),
+		"wrong audience": signTestToken(t, jwt.SigningMethodEdDSA, "ed", wrongAudience, edPrivate),
+		"unknown role":   signTestToken(t, jwt.SigningMethodEdDSA, "ed", unknownRole, edPrivate),
+		"no expiry":      signTestToken(t, jwt.SigningMethodEdDSA, "ed", noExpiry, edPrivate),
+		// RS256-токен с kid ключа EdDSA: алгоритм должен совпадать с ключом
+		"alg mismatch": signTestToken(t, jwt.SigningMethodRS256, "ed", testClaims("access"), rsaPrivate),
+		// HMAC с открытым ключом в качестве секрета — классическая подмена алгоритма
+		"HS256":        signTestToken(t, jwt.SigningMethodHS256, "ed", testClaims("access"), []byte(edPublic)),
+		"none":         signTestToken(t, jwt.SigningMethodNone, "ed", testClaims("access"), jwt.UnsafeAllowNoneSignatureType),
+		"unknown kid":  signTestToken(t, jwt.SigningMethodEdDSA, "other", testClaims("access"), edPrivate),
+		"basic scheme": "Basic dXNlcjpwYXNz",
+	}
+	for name, header := range rejected {
+		if p, err := parseAccessToken(ctx, header); err == nil {
+			t.Errorf("%s: accepted as %+v", name, p)
+		}
+	}
+
+	if p, err := parseAccessToken(ctx, ""); p != nil || err != nil {
+		t.Errorf("empty header: got %+v, %v, want anonymous request", p, err)
+	}
+}
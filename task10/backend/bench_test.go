@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Бенчмарки сравнивают построчную вставку с COPY на одном наборе данных.
+// Нужна база из переменных DB_*, без неё бенчмарки пропускаются. Каждая
+// транзакция откатывается, каталог не меняется:
+//
+//	go test -run '^$' -bench . -benchtime 20x
+const benchRows = 1000
+
+func BenchmarkInsertRows(b *testing.B) {
+	benchInsert(b, func(ctx context.Context, tx pgx.Tx, products []Product) error {
+		for i := range products {
+			p := &products[i]
+			if err := tx.QueryRow(ctx, stmtInsertProduct, p.SKU, p.Name, p.Price, p.Description, p.Categories).Scan(&p.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkCopyFrom(b *testing.B) {
+	benchInsert(b, copyProducts)
+}
+
+func benchInsert(b *testing.B, insert func(ctx context.Context, tx pgx.Tx, products []Product) error) {
+	pool := benchPool(b)
+	products := make([]Product, benchRows)
+	for i := range products {
+		products[i] = Product{
+			Name:        fmt.Sprintf("bench product %d", i),
+			Price:       float64(i%1000) + 0.99,
+			Description: "generated by insert benchmark",
+			Categories:  []string{"bench", fmt.Sprintf("group-%d", i%10)},
+		}
+	}
+
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = insert(ctx, tx, products)
+		tx.Rollback(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(benchRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+// benchPool открывает пул так же, как initDB, но пропускает бенчмарк вместо
+// ожидания базы: локально она обычно не запущена.
+func benchPool(b *testing.B) *pgxpool.Pool {
+	b.Helper()
+	cfg = LoadConfig()
+	poolCfg, err := pgxpool.ParseConfig(cfg.DB.DSN())
+	if err != nil {
+		b.Fatal(err)
+	}
+	poolCfg.AfterConnect = prepareStatements
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := pgx.ConnectConfig(ctx, poolCfg.ConnConfig)
+	if err != nil {
+		b.Skipf("database is not available: %v", err)
+	}
+	err = migrate(ctx, conn)
+	conn.Close(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolCfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(pool.Close)
+	return pool
+}
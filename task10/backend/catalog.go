@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// Категории в CSV хранятся в одной ячейке через этот разделитель.
+const csvCategorySeparator = "|"
+
+var csvHeader = []string{"sku", "name", "price", "description", "categories"}
+
+// Как часто (в строках) отправлять прогресс импорта в /ws.
+const importProgressEvery = 500
+
+// Сколько продуктов выгрузка подгружает за раз вместе с изображениями.
+const exportBatchSize = 500
+
+type ImportRowError struct {
+	Row   int    `json:"row"`
+	SKU   string `json:"sku,omitempty"`
+	Error string `json:"error"`
+}
+
+type ImportReport struct {
+	ImportID string           `json:"import_id"`
+	DryRun   bool             `json:"dry_run"`
+	Total    int              `json:"total"`
+	Created  int              `json:"created"`
+	Updated  int              `json:"updated"`
+	Failed   int              `json:"failed"`
+	Errors   []ImportRowError `json:"errors"`
+}
+
+// ImportProgress рассылается клиентам /ws во время импорта.
+type ImportProgress struct {
+	Type      string `json:"type"`
+	ImportID  string `json:"import_id"`
+	DryRun    bool   `json:"dry_run"`
+	Processed int    `json:"processed"`
+	Created   int    `json:"created"`
+	Updated   int    `json:"updated"`
+	Failed    int    `json:"failed"`
+	Done      bool   `json:"done"`
+}
+
+// @Summary Выгрузить каталог продуктов
+// @Tags Products
+// @Produce octet-stream
+// @Param format query string false "Формат выгрузки: csv, jsonl или xlsx" default(csv)
+// @Success 200 {file} file "Файл с каталогом"
+// @Failure 400 {object} problem.Problem "Неизвестный формат"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Router /products/export [get]
+func exportProducts(c *fiber.Ctx) error {
+	format := c.Query("format", "csv")
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		return problem.New(fiber.StatusBadRequest, "unsupported_format", "Unsupported format")
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="products.%s"`, format))
+
+	// Тело пишется уже после выхода из обработчика, поэтому ошибки можно только залогировать.
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.BulkTimeout)
+		defer cancel()
+
+		if err := writeCatalog(ctx, w, format); err != nil {
+			log.Printf("products export (%s) failed: %v", format, err)
+		}
+	})
+	return nil
+}
+
+var exportContentTypes = map[string]string{
+	"csv":   "text/csv; charset=utf-8",
+	"jsonl": "application/x-ndjson",
+	"xlsx":  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+type catalogEncoder interface {
+	Encode(p Product) error
+	Close() error
+}
+
+func newCatalogEncoder(w io.Writer, format string) (catalogEncoder, error) {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return nil, err
+		}
+		return csvEncoder{cw}, nil
+	case "jsonl":
+		return jsonlEncoder{json.NewEncoder(w)}, nil
+	case "xlsx":
+		xw, err := newXLSXWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		if err := xw.WriteRow("sku", "name", "price", "description", "categories"); err != nil {
+			return nil, err
+		}
+		return xlsxEncoder{xw}, nil
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+type csvEncoder struct{ w *csv.Writer }
+
+func (e csvEncoder) Encode(p Product) error {
+	return e.w.Write([]string{
+		p.SKU,
+		p.Name,
+		strconv.FormatFloat(p.Price, 'f', 2, 64),
+		p.Description,
+		strings.Join(p.Categories, csvCategorySeparator),
+	})
+}
+
+func (e csvEncoder) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonlEncoder struct{ enc *json.Encoder }
+
+func (e jsonlEncoder) Encode(p Product) error { return e.enc.Encode(p) }
+func (e jsonlEncoder) Close() error           { return nil }
+
+type xlsxEncoder struct{ w *xlsxWriter }
+
+func (e xlsxEncoder) Encode(p Product) error {
+	return e.w.WriteRow(p.SKU, p.Name, p.Price, p.Description, strings.Join(p.Categories, csvCategorySeparator))
+}
+
+func (e xlsxEncoder) Close() error { return e.w.Close() }
+
+func writeCatalog(ctx context.Context, w io.Writer, format string) error {
+	enc, err := newCatalogEncoder(w, format)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(ctx, stmtSelectProducts)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// Изображения есть только в JSON Lines; их подгружаем пачками, чтобы не
+	// держать в памяти весь каталог
+	withImages := format == "jsonl"
+	batch := make([]Product, 0, exportBatchSize)
+	flush := func() error {
+		if withImages {
+			if err := attachImages(ctx, batch); err != nil {
+				return err
+			}
+		}
+		for _, product := range batch {
+			if err := enc.Encode(product); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return err
+		}
+		if batch = append(batch, product); len(batch) == exportBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// @Summary Импортировать каталог из файла
+// @Description Строки сопоставляются по SKU: существующие продукты обновляются, новые создаются.
+// @Description В режиме dry_run изменения откатываются, но отчёт считается так же.
+// @Description Прогресс рассылается в /ws сообщениями с type=import_progress.
+// @Tags Products
+// @Accept mpfd
+// @Produce json
+// @Param file formData file true "CSV (sku,name,price,description,categories) или JSON Lines"
+// @Param format query string false "csv или jsonl; по умолчанию определяется по расширению файла"
+// @Param dry_run query bool false "Проверить файл без сохранения"
+// @Success 200 {object} ImportReport "Отчёт об импорте"
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Security BearerAuth
+// @Router /products/import [post]
+func importProducts(c *fiber.Ctx) error {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return problem.New(fiber.StatusBadRequest, "file_required", "File is required")
+	}
+
+	format := c.Query("format", strings.TrimPrefix(strings.ToLower(filepath.Ext(fileHeader.Filename)), "."))
+	if format != "csv" && format != "jsonl" {
+		return problem.New(fiber.StatusBadRequest, "unsupported_format", "Unsupported format")
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return problem.New(fiber.StatusBadRequest, "invalid_file", "Invalid file")
+	}
+	defer file.Close()
+
+	dec, err := newCatalogDecoder(file, format)
+	if err != nil {
+		return problem.New(fiber.StatusBadRequest, "invalid_file", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), cfg.BulkTimeout)
+	defer cancel()
+
+	report, err := runImport(ctx, dec, c.QueryBool("dry_run"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(report)
+}
+
+// rowError — ошибка разбора одной строки файла, после неё импорт продолжается.
+type rowError struct {
+	err error
+}
+
+func (e *rowError) Error() string { return e.err.Error() }
+
+type catalogDecoder interface {
+	// Next возвращает номер строки в файле и продукт, *rowError для битой строки
+	// или io.EOF в конце файла.
+	Next() (int, Product, error)
+}
+
+func newCatalogDecoder(r io.Reader, format string) (catalogDecoder, error) {
+	if format == "jsonl" {
+		s := bufio.NewScanner(r)
+		s.Buffer(make([]byte, 64*1024), 1024*1024)
+		return &jsonlDecoder{s: s}, nil
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, required := range []string{"sku", "name", "price"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV header must contain %q column", required)
+		}
+	}
+	return &csvDecoder{r: cr, columns: columns, row: 1}, nil
+}
+
+type csvDecoder struct {
+	r       *csv.Reader
+	columns map[string]int
+	row     int
+}
+
+func (d *csvDecoder) Next() (int, Product, error) {
+	record, err := d.r.Read()
+	d.row++
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return d.row, Product{}, &rowError{err: parseErr.Err}
+	}
+	if err != nil {
+		return d.row, Product{}, err
+	}
+
+	field := func(name string) string {
+		if i, ok := d.columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	product := Product{
+		SKU:         field("sku"),
+		Name:        field("name"),
+		Description: field("description"),
+	}
+	if categories := field("categories"); categories != "" {
+		for _, category := range strings.Split(categories, csvCategorySeparator) {
+			if category = strings.TrimSpace(category); category != "" {
+				product.Categories = append(product.Categories, category)
+			}
+		}
+	}
+
+	// Excel с русской локалью сохраняет дробную часть через запятую
+	price, err := strconv.ParseFloat(strings.ReplaceAll(field("price"), ",", "."), 64)
+	if err != nil {
+		return d.row, product, &rowError{err: errors.New("invalid price")}
+	}
+	product.Price = price
+
+	return d.row, product, nil
+}
+
+type jsonlDecoder struct {
+	s   *bufio.Scanner
+	row int
+}
+
+func (d *jsonlDecoder) Next() (int, Product, error) {
+	for d.s.Scan() {
+		d.row++
+		line := strings.TrimSpace(d.s.Text())
+		if line == "" {
+			continue
+		}
+		var product Product
+		if err := json.Unmarshal([]byte(line), &product); err != nil {
+			return d.row, Product{}, &rowError{err: errors.New("invalid JSON")}
+		}
+		product.ID = 0
+		return d.row, product, nil
+	}
+	if err := d.s.Err(); err != nil {
+		return d.row, Product{}, err
+	}
+	return d.row, Product{}, io.EOF
+}
+
+func validateImportedProduct(p Product) error {
+	switch {
+	case p.SKU == "":
+		return errors.New("sku is required")
+	case len(p.SKU) > 64:
+		return errors.New("sku is longer than 64 characters")
+	case p.Name == "":
+		return errors.New("name is required")
+	case math.IsNaN(p.Price) || math.IsInf(p.Price, 0):
+		// ParseFloat принимает "NaN" и "Inf", а NaN не меньше нуля
+		return errors.New("price must be a finite number")
+	case p.Price < 0:
+		return errors.New("price must not be negative")
+	}
+	return nil
+}
+
+// runImport выполняет импорт в одной транзакции. Каждая строка пишется в своей
+// точке сохранения, чтобы ошибка в ней не обрывала весь файл.
+func runImport(ctx context.Context, dec catalogDecoder, dryRun bool) (*ImportReport, error) {
+	report := &ImportReport{
+		ImportID: newRandomID(),
+		DryRun:   dryRun,
+		Errors:   []ImportRowError{},
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	fail := func(row int, sku string, err error) {
+		report.Failed++
+		report.Errors = append(report.Errors, ImportRowError{Row: row, SKU: sku, Error: err.Error()})
+	}
+
+	for {
+		row, product, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+
+		var badRow *rowError
+		if err != nil && !errors.As(err, &badRow) {
+			return nil, err
+		}
+
+		report.Total++
+		if badRow != nil {
+			fail(row, product.SKU, badRow)
+		} else if err := validateImportedProduct(product); err != nil {
+			fail(row, product.SKU, err)
+		} else if created, err := upsertProduct(ctx, tx, product); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// Текст ошибки БД в отчёт не попадает, как и в ответы API
+			p := problem.FromDB(err, cfg.Production())
+			if p.Detail == "" {
+				p.Detail = p.Title
+			}
+			fail(row, product.SKU, errors.New(p.Detail))
+		} else if created {
+			report.Created++
+		} else {
+			report.Updated++
+		}
+
+		if report.Total%importProgressEvery == 0 {
+			publishEvent(report.progress(false))
+		}
+	}
+
+	if !dryRun {
+		if err := tx.Commit(ctx); err != nil {
+			return nil, err
+		}
+		invalidateProducts(ctx)
+	}
+
+	publishEvent(report.progress(true))
+	return report, nil
+}
+
+func upsertProduct(ctx context.Context, tx pgx.Tx, p Product) (created bool, err error) {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer savepoint.Rollback(ctx)
+
+	var (
+		id     int
+		before ProductSnapshot
+	)
+	err = savepoint.QueryRow(ctx, stmtLockProductSKU, p.SKU).
+		Scan(&id, &before.SKU, &before.Name, &before.Price, &before.Description, &before.Categories, &before.Deleted)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return false, err
+	}
+	if before.Categories == nil {
+		before.Categories = []string{}
+	}
+
+	err = savepoint.QueryRow(ctx, stmtUpsertProduct, p.SKU, p.Name, p.Price, p.Description, p.Categories).Scan(&id, &created)
+	if err != nil {
+		return false, err
+	}
+
+	beforePtr := &before
+	if created {
+		beforePtr = nil
+	}
+	if err := recordAudit(ctx, savepoint, id, auditImport, beforePtr, snapshotOf(p, false), nil); err != nil {
+		return false, err
+	}
+	return created, savepoint.Commit(ctx)
+}
+
+func (r *ImportReport) progress(done bool) ImportProgress {
+	return ImportProgress{
+		Type:      "import_progress",
+		ImportID:  r.ImportID,
+		DryRun:    r.DryRun,
+		Processed: r.Total,
+		Created:   r.Created,
+		Updated:   r.Updated,
+		Failed:    r.Failed,
+		Done:      done,
+	}
+}
+
+func newRandomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCSVDecoder(t *testing.T) {
+	input := "\ufeffSKU, Name ,Price,Categories\n" +
+		"A-1,Lamp,\"12,50\",light | desk\n" +
+		"A-2,Chair,cheap,\n" +
+		"A-3,Table,40,\n"
+	dec, err := newCatalogDecoder(strings.NewReader(input), "csv")
+	if err != nil {
+		t.Fatalf("newCatalogDecoder: %v", err)
+	}
+
+	row, p, err := dec.Next()
+	if err != nil {
+		t.Fatalf("row %d: %v", row, err)
+	}
+	// Первая строка с данными — вторая в файле, после заголовка
+	if row != 2 || p.SKU != "A-1" || p.Name != "Lamp" || p.Price != 12.5 {
+		t.Errorf("row %d: got %+v", row, p)
+	}
+	if !reflect.DeepEqual(p.Categories, []string{"light", "desk"}) {
+		t.Errorf("categories = %q", p.Categories)
+	}
+
+	row, p, err = dec.Next()
+	var badRow *rowError
+	if !errors.As(err, &badRow) || err.Error() != "invalid price" {
+		t.Fatalf("row %d: got %v, want invalid price row error", row, err)
+	}
+	if row != 3 || p.SKU != "A-2" {
+		t.Errorf("row %d: got %+v, want A-2 in row 3", row, p)
+	}
+
+	row, p, err = dec.Next()
+	if err != nil || row != 4 || p.SKU != "A-3" || p.Categories != nil {
+		t.Errorf("row %d: got %+v, %v", row, p, err)
+	}
+
+	if _, _, err = dec.Next(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
+
+func TestCSVDecoderRequiresColumns(t *testing.T) {
+	for _, header := range []string{"sku,name\n", "name,price\n", ""} {
+		if _, err := newCatalogDecoder(strings.NewReader(header), "csv"); err == nil {
+			t.Errorf("header %q: expected error", header)
+		}
+	}
+}
+
+func TestJSONLDecoder(t *testing.T) {
+	input := `{"id":7,"sku":"A-1","name":"Lamp","price":10}` + "\n" +
+		"\n" +
+		"{broken\n" +
+		`{"sku":"A-2","name":"Chair","price":5,"categories":["home"]}` + "\n"
+	dec, err := newCatalogDecoder(strings.NewReader(input), "jsonl")
+	if err != nil {
+		t.Fatalf("newCatalogDecoder: %v", err)
+	}
+
+	row, p, err := dec.Next()
+	if err != nil || row != 1 || p.SKU != "A-1" {
+		t.Fatalf("row %d: got %+v, %v", row, p, err)
+	}
+	if p.ID != 0 {
+		t.Errorf("id = %v, want it ignored on import", p.ID)
+	}
+
+	// Пустая строка пропускается, но номера строк остаются номерами в файле
+	row, _, err = dec.Next()
+	var badRow *rowError
+	if !errors.As(err, &badRow) || err.Error() != "invalid JSON" || row != 3 {
+		t.Fatalf("row %d: got %v, want invalid JSON row error in row 3", row, err)
+	}
+
+	row, p, err = dec.Next()
+	if err != nil || row != 4 || p.SKU != "A-2" || !reflect.DeepEqual(p.Categories, []string{"home"}) {
+		t.Fatalf("row %d: got %+v, %v", row, p, err)
+	}
+
+	if _, _, err = dec.Next(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
+
+func TestValidateImportedProduct(t *testing.T) {
+	tests := []struct {
+		product Product
+		want    string
+	}{
+		{Product{SKU: "A-1", Name: "Lamp", Price: 0}, ""},
+		{Product{Name: "Lamp", Price: 1}, "sku is required"},
+		{Product{SKU: strings.Repeat("x", 65), Name: "Lamp", Price: 1}, "sku is longer than 64 characters"},
+		{Product{SKU: strings.Repeat("x", 64), Name: "Lamp", Price: 1}, ""},
+		{Product{SKU: "A-1", Price: 1}, "name is required"},
+		{Product{SKU: "A-1", Name: "Lamp", Price: -0.01}, "price must not be negative"},
+		{Product{SKU: "A-1", Name: "Lamp", Price: math.NaN()}, "price must be a finite number"},
+		{Product{SKU: "A-1", Name: "Lamp", Price: math.Inf(1)}, "price must be a finite number"},
+		{Product{SKU: "A-1", Name: "Lamp", Price: math.Inf(-1)}, "price must be a finite number"},
+	}
+	for _, tt := range tests {
+		err := validateImportedProduct(tt.product)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.product, got, tt.want)
+		}
+	}
+}
+
+func TestCSVDecoderNonFinitePrice(t *testing.T) {
+	dec, err := newCatalogDecoder(strings.NewReader("sku,name,price\nA-1,Lamp,NaN\nA-2,Chair,1e400\n"), "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NaN разбирается как число, строку отклоняет проверка перед вставкой
+	_, p, err := dec.Next()
+	if err != nil {
+		t.Fatalf("NaN: %v", err)
+	}
+	if err := validateImportedProduct(p); err == nil {
+		t.Error("NaN price passed validation")
+	}
+	// Переполнение ParseFloat отдаёт ошибкой
+	if _, _, err := dec.Next(); err == nil || err.Error() != "invalid price" {
+		t.Errorf("1e400: got %v, want invalid price", err)
+	}
+}
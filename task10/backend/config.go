@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"shared/sqldb"
+)
+
+type Config struct {
+	// production скрывает от клиентов текст внутренних ошибок, development показывает его в detail
+	Environment string
+
+	// Адрес базы, время жизни соединений, ожидание при запуске и таймаут запросов
+	// из переменных DB_*, как у остальных сервисов
+	DB sqldb.Config
+
+	// Access-токены сервиса авторизации (sem13-14) проверяются по открытым ключам из JWKS
+	JWKSURL      string
+	JWKSCacheTTL time.Duration
+	JWTIssuer    string
+	JWTAudience  string
+
+	// Размер пула pgx; DB_MAX_OPEN_CONNS и DB_MAX_IDLE_CONNS для него не используются
+	DBMaxConns int
+	DBMinConns int
+
+	// Максимальное время запросов к БД при импорте и выгрузке всего каталога
+	BulkTimeout time.Duration
+
+	BodyLimit int
+
+	ImagesDir     string
+	ImagesBaseURL string
+	ImageMaxSize  int
+	ThumbnailSize int
+
+	// Кэш списка продуктов в Redis, общий для реплик; пустой REDIS_URL выключает кэш
+	RedisURL         string
+	ProductsCacheTTL time.Duration
+
+	// Лимиты частоты запросов по группам маршрутов, "<запросов>/<период>" или "off".
+	// При заданном REDIS_URL счётчики общие для всех реплик
+	RateLimitRead    RateLimit
+	RateLimitWrite   RateLimit
+	RateLimitGraphQL RateLimit
+	// Сообщения чата в /ws, считаются на каждое входящее сообщение
+	RateLimitWS RateLimit
+	// Адреса nginx через запятую (IP или подсети), которым доверяется X-Forwarded-For
+	TrustedProxies string
+
+	// Сколько продукт хранится в корзине перед окончательным удалением
+	TrashRetention     time.Duration
+	TrashPurgeInterval time.Duration
+}
+
+func LoadConfig() *Config {
+	cfg := &Config{
+		Environment: getEnv("APP_ENV", "production"),
+
+		DB: sqldb.FromEnv(),
+
+		JWKSURL:      getEnv("JWKS_URL", "http://host.docker.internal/.well-known/jwks.json"),
+		JWKSCacheTTL: getEnvDuration("JWKS_CACHE_TTL", 10*time.Minute),
+		JWTIssuer:    getEnv("JWT_ISSUER", "auth-service"),
+		JWTAudience:  getEnv("JWT_AUDIENCE", "front2sem"),
+
+		DBMaxConns: getEnvInt("DB_MAX_CONNS", 15),
+		DBMinConns: getEnvInt("DB_MIN_CONNS", 2),
+
+		BulkTimeout: getEnvDuration("DB_BULK_TIMEOUT", 5*time.Minute),
+
+		BodyLimit: getEnvInt("BODY_LIMIT_MB", 32) * 1024 * 1024,
+
+		ImagesDir:     getEnv("IMAGES_DIR", "/data/images"),
+		ImagesBaseURL: getEnv("IMAGES_BASE_URL", "/api/images"),
+		ImageMaxSize:  getEnvInt("IMAGE_MAX_MB", 10) * 1024 * 1024,
+		ThumbnailSize: getEnvInt("THUMBNAIL_SIZE", 320),
+
+		RedisURL:         getEnv("REDIS_URL", ""),
+		ProductsCacheTTL: getEnvDuration("PRODUCTS_CACHE_TTL", 10*time.Minute),
+
+		RateLimitRead:    getEnvRateLimit("RATE_LIMIT_READ", RateLimit{Burst: 300, Period: time.Minute}),
+		RateLimitWrite:   getEnvRateLimit("RATE_LIMIT_WRITE", RateLimit{Burst: 60, Period: time.Minute}),
+		RateLimitGraphQL: getEnvRateLimit("RATE_LIMIT_GRAPHQL", RateLimit{Burst: 120, Period: time.Minute}),
+		RateLimitWS:      getEnvRateLimit("RATE_LIMIT_WS", RateLimit{Burst: 20, Period: 10 * time.Second}),
+		TrustedProxies:   getEnv("TRUSTED_PROXIES", "127.0.0.1,::1"),
+
+		TrashRetention:     getEnvDuration("TRASH_RETENTION", 30*24*time.Hour),
+		TrashPurgeInterval: getEnvDuration("TRASH_PURGE_INTERVAL", time.Hour),
+	}
+	return cfg
+}
+
+func (c *Config) Production() bool {
+	return c.Environment != "development"
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+// getEnvRateLimit останавливает запуск на некорректном значении: опечатка в
+// лимите не должна молча превращаться в значение по умолчанию.
+func getEnvRateLimit(key string, defaultValue RateLimit) RateLimit {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	return limit
+}
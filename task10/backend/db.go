@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"shared/sqldb"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var db *pgxpool.Pool
+
+// Именованные запросы, которые готовятся на каждом соединении пула при подключении.
+const (
+	stmtSelectProducts = "select_products"
+	stmtInsertProduct  = "insert_product"
+	stmtUpsertProduct  = "upsert_product"
+	stmtUpdateProduct  = "update_product"
+	stmtDeleteProduct  = "delete_product"
+	stmtSelectTrash    = "select_trash"
+	stmtRestoreProduct = "restore_product"
+	stmtRevertProduct  = "revert_product"
+	stmtLockProduct    = "lock_product"
+	stmtLockProductSKU = "lock_product_sku"
+	stmtInsertAudit    = "insert_audit"
+	stmtSelectAudit    = "select_audit"
+	stmtSelectImages   = "select_images"
+	stmtInsertImage    = "insert_image"
+	stmtDeleteImage    = "delete_image"
+)
+
+const productSelectColumns = "id, COALESCE(sku, ''), name, price, COALESCE(description, ''), categories, deleted_at"
+
+var preparedStatements = map[string]string{
+	stmtSelectProducts: "SELECT " + productSelectColumns + " FROM products WHERE deleted_at IS NULL ORDER BY id",
+	stmtInsertProduct:  "INSERT INTO products (sku, name, price, description, categories) VALUES (NULLIF($1, ''), $2, $3, $4, $5) RETURNING id",
+	// xmax = 0 только у только что вставленной строки, так отличаем вставку от обновления.
+	// Продукт из корзины с тем же SKU при импорте восстанавливается.
+	stmtUpsertProduct: `INSERT INTO products (sku, name, price, description, categories) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (sku) DO UPDATE SET name=EXCLUDED.name, price=EXCLUDED.price, description=EXCLUDED.description, categories=EXCLUDED.categories, deleted_at=NULL
+		RETURNING id, xmax = 0`,
+	stmtUpdateProduct:  "UPDATE products SET sku=NULLIF($1, ''), name=$2, price=$3, description=$4, categories=$5 WHERE id=$6 AND deleted_at IS NULL",
+	stmtDeleteProduct:  "UPDATE products SET deleted_at=NOW() WHERE id=$1 AND deleted_at IS NULL",
+	stmtSelectTrash:    "SELECT " + productSelectColumns + " FROM products WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC",
+	stmtRestoreProduct: "UPDATE products SET deleted_at=NULL WHERE id=$1 AND deleted_at IS NOT NULL",
+	stmtRevertProduct: `UPDATE products SET sku=NULLIF($1, ''), name=$2, price=$3, description=$4, categories=$5,
+		deleted_at = CASE WHEN $6::boolean THEN COALESCE(deleted_at, NOW()) END WHERE id=$7`,
+	stmtLockProduct:    "SELECT COALESCE(sku, ''), name, price, COALESCE(description, ''), categories, deleted_at IS NOT NULL FROM products WHERE id=$1 FOR UPDATE",
+	stmtLockProductSKU: "SELECT id, COALESCE(sku, ''), name, price, COALESCE(description, ''), categories, deleted_at IS NOT NULL FROM products WHERE sku=$1 FOR UPDATE",
+	stmtInsertAudit: `INSERT INTO product_audit (product_id, version, operation, actor, changes, snapshot, reverted_to)
+		VALUES ($1, (SELECT COALESCE(MAX(version), 0) + 1 FROM product_audit WHERE product_id = $1), $2, $3, $4, $5, $6)`,
+	stmtSelectAudit:  "SELECT version, operation, actor, changed_at, changes, snapshot, reverted_to FROM product_audit WHERE product_id=$1 ORDER BY version DESC",
+	stmtSelectImages: "SELECT id, product_id, storage_key, thumbnail_key FROM product_images WHERE product_id = ANY($1) ORDER BY product_id, id",
+	stmtInsertImage:  "INSERT INTO product_images (product_id, storage_key, thumbnail_key, content_type) VALUES ($1, $2, $3, $4) RETURNING id",
+	stmtDeleteImage:  "DELETE FROM product_images WHERE id=$1 AND product_id=$2 RETURNING storage_key, thumbnail_key",
+}
+
+func initDB() {
+	poolCfg, err := pgxpool.ParseConfig(cfg.DB.DSN())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	poolCfg.MaxConns = int32(cfg.DBMaxConns)
+	poolCfg.MinConns = int32(cfg.DBMinConns)
+	poolCfg.MaxConnLifetime = cfg.DB.ConnMaxLifetime
+	poolCfg.MaxConnIdleTime = cfg.DB.ConnMaxIdleTime
+	poolCfg.AfterConnect = prepareStatements
+
+	// Схема создаётся на отдельном соединении до открытия пула:
+	// запросы готовятся при подключении и требуют существующих таблиц.
+	var conn *pgx.Conn
+	err = sqldb.Wait(func(ctx context.Context) (err error) {
+		conn, err = pgx.ConnectConfig(ctx, poolCfg.ConnConfig)
+		return err
+	}, cfg.DB.ConnectAttempts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = migrate(context.Background(), conn)
+	conn.Close(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err = pgxpool.NewWithConfig(context.Background(), poolCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func migrate(ctx context.Context, conn *pgx.Conn) error {
+	// Реплики стартуют одновременно; блокировка держится до конца неявной транзакции всего скрипта.
+	_, err := conn.Exec(ctx, `
+	SELECT pg_advisory_xact_lock(7300);
+
+	CREATE TABLE IF NOT EXISTS products (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		price DECIMAL(10, 2) NOT NULL,
+		description TEXT,
+		categories TEXT[]
+	);
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS sku VARCHAR(64) UNIQUE;
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS products_deleted_at_idx ON products(deleted_at) WHERE deleted_at IS NOT NULL;
+
+	CREATE TABLE IF NOT EXISTS product_images (
+		id SERIAL PRIMARY KEY,
+		product_id INT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+		storage_key TEXT NOT NULL,
+		thumbnail_key TEXT NOT NULL,
+		content_type VARCHAR(64) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS product_images_product_id_idx ON product_images(product_id);
+
+	-- Без внешнего ключа: история должна переживать окончательное удаление продукта.
+	CREATE TABLE IF NOT EXISTS product_audit (
+		id BIGSERIAL PRIMARY KEY,
+		product_id INT NOT NULL,
+		version INT NOT NULL,
+		operation VARCHAR(16) NOT NULL,
+		actor TEXT NOT NULL,
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		changes JSONB NOT NULL,
+		snapshot JSONB NOT NULL,
+		reverted_to INT,
+		UNIQUE (product_id, version)
+	);
+
+	CREATE OR REPLACE FUNCTION product_audit_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'product_audit is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS product_audit_append_only ON product_audit;
+	CREATE TRIGGER product_audit_append_only BEFORE UPDATE OR DELETE ON product_audit
+		FOR EACH ROW EXECUTE FUNCTION product_audit_append_only();
+	`)
+	return err
+}
+
+func prepareStatements(ctx context.Context, conn *pgx.Conn) error {
+	for name, sql := range preparedStatements {
+		if _, err := conn.Prepare(ctx, name, sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/gofiber/adaptor/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/handler"
+)
+
+var imageType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "ProductImage",
+		Fields: graphql.Fields{
+			"id":            &graphql.Field{Type: graphql.Int},
+			"url":           &graphql.Field{Type: graphql.String},
+			"thumbnail_url": &graphql.Field{Type: graphql.String},
+		},
+	},
+)
+
+// Старое и новое значение поля отдаются JSON-строкой: тип у полей разный.
+var fieldChangeType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "FieldChange",
+		Fields: graphql.Fields{
+			"field": &graphql.Field{Type: graphql.String},
+			"old":   &graphql.Field{Type: graphql.String, Resolve: rawJSONResolver(func(c FieldChange) json.RawMessage { return c.Old })},
+			"new":   &graphql.Field{Type: graphql.String, Resolve: rawJSONResolver(func(c FieldChange) json.RawMessage { return c.New })},
+		},
+	},
+)
+
+var auditEntryType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "AuditEntry",
+		Fields: graphql.Fields{
+			"version":     &graphql.Field{Type: graphql.Int},
+			"operation":   &graphql.Field{Type: graphql.String},
+			"actor":       &graphql.Field{Type: graphql.String},
+			"changed_at":  &graphql.Field{Type: graphql.DateTime},
+			"changes":     &graphql.Field{Type: graphql.NewList(fieldChangeType)},
+			"reverted_to": &graphql.Field{Type: graphql.Int},
+		},
+	},
+)
+
+var productType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "Product",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.Int},
+			"sku":         &graphql.Field{Type: graphql.String},
+			"name":        &graphql.Field{Type: graphql.String},
+			"price":       &graphql.Field{Type: graphql.Float},
+			"description": &graphql.Field{Type: graphql.String},
+			"categories":  &graphql.Field{Type: graphql.NewList(graphql.String)},
+			"images":      &graphql.Field{Type: graphql.NewList(imageType)},
+			"history": &graphql.Field{
+				Type: graphql.NewList(auditEntryType),
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if err := checkRole(params.Context, roleViewer); err != nil {
+						return nil, err
+					}
+					return productHistory(params.Context, params.Source.(Product).ID)
+				},
+			},
+		},
+	},
+)
+
+var productInputType = graphql.NewInputObject(
+	graphql.InputObjectConfig{
+		Name: "ProductInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"sku":         &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"name":        &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"price":       &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Float)},
+			"description": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"categories":  &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.String)},
+		},
+	},
+)
+
+func rawJSONResolver(get func(FieldChange) json.RawMessage) graphql.FieldResolveFn {
+	return func(params graphql.ResolveParams) (interface{}, error) {
+		return string(get(params.Source.(FieldChange))), nil
+	}
+}
+
+func productFromInput(input map[string]interface{}) Product {
+	p := Product{Categories: []string{}}
+	p.SKU, _ = input["sku"].(string)
+	p.Name, _ = input["name"].(string)
+	p.Price, _ = input["price"].(float64)
+	p.Description, _ = input["description"].(string)
+	if categories, ok := input["categories"].([]interface{}); ok {
+		for _, c := range categories {
+			if s, ok := c.(string); ok {
+				p.Categories = append(p.Categories, s)
+			}
+		}
+	}
+	return p
+}
+
+var idArgs = graphql.FieldConfigArgument{
+	"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+}
+
+func createSchema() graphql.Schema {
+
+	rootQuery := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"products": &graphql.Field{
+				Type: graphql.NewList(productType),
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					return cachedProducts(params.Context)
+				},
+			},
+			"productHistory": &graphql.Field{
+				Type: graphql.NewList(auditEntryType),
+				Args: idArgs,
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if err := checkRole(params.Context, roleViewer); err != nil {
+						return nil, err
+					}
+					return productHistory(params.Context, params.Args["id"].(int))
+				},
+			},
+		},
+	})
+
+	rootMutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createProduct": &graphql.Field{
+				Type: productType,
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(productInputType)},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if err := checkRole(params.Context, roleEditor); err != nil {
+						return nil, err
+					}
+					products := []Product{productFromInput(params.Args["input"].(map[string]interface{}))}
+					if err := insertProducts(params.Context, products); err != nil {
+						return nil, err
+					}
+					products[0].Images = []ProductImage{}
+					return products[0], nil
+				},
+			},
+			"updateProduct": &graphql.Field{
+				Type: graphql.Boolean,
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(productInputType)},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if err := checkRole(params.Context, roleEditor); err != nil {
+						return nil, err
+					}
+					product := productFromInput(params.Args["input"].(map[string]interface{}))
+					return true, updateProductByID(params.Context, params.Args["id"].(int), product)
+				},
+			},
+			"deleteProduct": &graphql.Field{
+				Type: graphql.Boolean,
+				Args: idArgs,
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if err := checkRole(params.Context, roleEditor); err != nil {
+						return nil, err
+					}
+					return true, deleteProductByID(params.Context, params.Args["id"].(int))
+				},
+			},
+			"restoreProduct": &graphql.Field{
+				Type: graphql.Boolean,
+				Args: idArgs,
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if err := checkRole(params.Context, roleEditor); err != nil {
+						return nil, err
+					}
+					return true, restoreProductByID(params.Context, params.Args["id"].(int))
+				},
+			},
+			"revertProduct": &graphql.Field{
+				Type: graphql.Boolean,
+				Args: graphql.FieldConfigArgument{
+					"id":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"version": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if err := checkRole(params.Context, roleAdmin); err != nil {
+						return nil, err
+					}
+					return true, revertProductToVersion(params.Context, params.Args["id"].(int), params.Args["version"].(int))
+				},
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query:    rootQuery,
+		Mutation: rootMutation,
+	})
+	if err != nil {
+		log.Fatalf("failed to create new schema, error: %v", err)
+	}
+	return schema
+}
+
+// @Summary Запрос GraphQL
+// @Description Схема на языке SDL публикуется по адресу /api/swagger/schema.graphql. Ошибки выполнения
+// @Description приходят в errors со статусом 200, code и status ошибки — в extensions.
+// @Tags GraphQL
+// @Accept json
+// @Produce json
+// @Param request body GraphQLRequest true "Запрос"
+// @Success 200 {object} GraphQLResponse "Результат запроса"
+// @Failure 401 {object} problem.Problem "Недействительный токен"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Security BearerAuth
+// @Router /graphql [post]
+func newGraphQLHandler(schema graphql.Schema) fiber.Handler {
+	h := handler.New(&handler.Config{
+		Schema:        &schema,
+		Pretty:        true,
+		FormatErrorFn: formatGraphQLError,
+	})
+	return adaptor.HTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// adaptor не переносит контекст fiber, поэтому таймаут для резолверов задаём здесь
+		ctx, err := graphqlContext(r)
+		if err != nil {
+			writeProblem(w, r, errInvalidToken)
+			return
+		}
+		ctx, cancel := cfg.DB.QueryContext(ctx)
+		defer cancel()
+		h.ContextHandler(ctx, w, r)
+	})
+}
+
+// graphqlContext повторяет authMiddleware для запросов, прошедших через adaptor.
+func graphqlContext(r *http.Request) (context.Context, error) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := trustedProxies.ClientIP(net.ParseIP(host), r.Header.Values("X-Forwarded-For"))
+	return authenticate(r.Context(), r.Header.Get("Authorization"), ip)
+}
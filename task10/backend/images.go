@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"path"
+
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Ограничение на размер картинки в пикселях, защищает от «бомб» при декодировании.
+const maxImagePixels = 25_000_000
+
+var imageStorage ImageStorage
+
+type ProductImage struct {
+	ID           int    `json:"id"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+var imageExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"webp": ".webp",
+}
+
+// attachImages подгружает изображения для уже выбранных продуктов одним
+// запросом по их ID.
+func attachImages(ctx context.Context, products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]int, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+
+	byProduct := make(map[int][]ProductImage, len(products))
+	rows, err := db.Query(ctx, stmtSelectImages, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			productID         int
+			img               ProductImage
+			key, thumbnailKey string
+		)
+		if err := rows.Scan(&img.ID, &productID, &key, &thumbnailKey); err != nil {
+			return err
+		}
+		img.URL = imageStorage.URL(key)
+		img.ThumbnailURL = imageStorage.URL(thumbnailKey)
+		byProduct[productID] = append(byProduct[productID], img)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range products {
+		products[i].Images = byProduct[products[i].ID]
+		if products[i].Images == nil {
+			products[i].Images = []ProductImage{}
+		}
+	}
+	return nil
+}
+
+// @Summary Загрузить изображения продукта
+// @Description Принимает один или несколько файлов JPEG, PNG, GIF или WebP. Для каждого создаётся миниатюра.
+// @Description Если хотя бы один файл не принят, не сохраняется ни один.
+// @Tags Images
+// @Accept mpfd
+// @Produce json
+// @Param id path int true "ID продукта"
+// @Param image formData file true "Файл изображения"
+// @Success 201 {array} ProductImage "Загруженные изображения"
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 404 {object} problem.Problem "Продукт не найден"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Security BearerAuth
+// @Router /products/{id}/images [post]
+func uploadProductImages(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return errInvalidProductID
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["image"]) == 0 {
+		return problem.New(fiber.StatusBadRequest, "file_required", "Image file is required")
+	}
+
+	ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+	defer cancel()
+
+	// Файлы сохраняются все или ни одного: строки пишутся в одной транзакции,
+	// а при ошибке на любом файле уже сохранённые удаляются из хранилища
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM products WHERE id = $1 AND deleted_at IS NULL)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errProductNotFound
+	}
+
+	images := make([]ProductImage, 0, len(form.File["image"]))
+	var savedKeys []string
+	for _, fileHeader := range form.File["image"] {
+		img, keys, err := saveProductImage(ctx, tx, id, fileHeader)
+		if err != nil {
+			removeImageFiles(savedKeys...)
+			var badImage *badImageError
+			if errors.As(err, &badImage) {
+				return problem.New(fiber.StatusBadRequest, "invalid_image", fmt.Sprintf("%s: %s", fileHeader.Filename, badImage.msg))
+			}
+			return err
+		}
+		images = append(images, img)
+		savedKeys = append(savedKeys, keys...)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		removeImageFiles(savedKeys...)
+		return err
+	}
+	invalidateProducts(ctx)
+
+	return c.Status(fiber.StatusCreated).JSON(images)
+}
+
+type badImageError struct{ msg string }
+
+func (e *badImageError) Error() string { return e.msg }
+
+// saveProductImage кладёт файл и миниатюру в хранилище и пишет строку в tx.
+// Возвращает ключи сохранённых файлов, чтобы их можно было удалить, если
+// транзакция не зафиксируется; при собственной ошибке файлы удаляет сама.
+func saveProductImage(ctx context.Context, tx pgx.Tx, productID int, fileHeader *multipart.FileHeader) (ProductImage, []string, error) {
+	if fileHeader.Size > int64(cfg.ImageMaxSize) {
+		return ProductImage{}, nil, &badImageError{"file is too large"}
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return ProductImage{}, nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, int64(cfg.ImageMaxSize)+1))
+	if err != nil {
+		return ProductImage{}, nil, err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	ext, supported := imageExtensions[format]
+	if err != nil || !supported {
+		return ProductImage{}, nil, &badImageError{"unsupported image format"}
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return ProductImage{}, nil, &badImageError{"image dimensions are too large"}
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ProductImage{}, nil, &badImageError{"corrupted image"}
+	}
+	thumbnail, err := makeThumbnail(src, cfg.ThumbnailSize)
+	if err != nil {
+		return ProductImage{}, nil, err
+	}
+
+	name := newRandomID()
+	key := fmt.Sprintf("products/%d/%s%s", productID, name, ext)
+	thumbnailKey := fmt.Sprintf("products/%d/%s_thumb.jpg", productID, name)
+
+	if err := imageStorage.Save(ctx, key, bytes.NewReader(data)); err != nil {
+		return ProductImage{}, nil, err
+	}
+	if err := imageStorage.Save(ctx, thumbnailKey, bytes.NewReader(thumbnail)); err != nil {
+		removeImageFiles(key)
+		return ProductImage{}, nil, err
+	}
+
+	img := ProductImage{URL: imageStorage.URL(key), ThumbnailURL: imageStorage.URL(thumbnailKey)}
+	err = tx.QueryRow(ctx, stmtInsertImage, productID, key, thumbnailKey, mime.TypeByExtension(ext)).Scan(&img.ID)
+	if err != nil {
+		removeImageFiles(key, thumbnailKey)
+		return ProductImage{}, nil, err
+	}
+	return img, []string{key, thumbnailKey}, nil
+}
+
+// makeThumbnail вписывает изображение в квадрат size×size и кодирует в JPEG.
+// Прозрачные области заливаются белым.
+func makeThumbnail(src image.Image, size int) ([]byte, error) {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// @Summary Удалить изображение продукта
+// @Tags Images
+// @Produce json
+// @Param id path int true "ID продукта"
+// @Param imageId path int true "ID изображения"
+// @Success 200 {object} map[string]string "Изображение удалено"
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 404 {object} problem.Problem "Изображение не найдено"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Security BearerAuth
+// @Router /products/{id}/images/{imageId} [delete]
+func deleteProductImage(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return errInvalidProductID
+	}
+	imageID, err := c.ParamsInt("imageId")
+	if err != nil {
+		return problem.New(fiber.StatusBadRequest, "invalid_image_id", "Invalid image id")
+	}
+
+	ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+	defer cancel()
+
+	var key, thumbnailKey string
+	err = db.QueryRow(ctx, stmtDeleteImage, imageID, id).Scan(&key, &thumbnailKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return problem.New(fiber.StatusNotFound, "image_not_found", "Image not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	removeImageFiles(key, thumbnailKey)
+	invalidateProducts(ctx)
+	return c.JSON(fiber.Map{"message": "Image deleted successfully"})
+}
+
+// serveImage отдаёт файлы из ImageStorage. Ключи уникальны и не переиспользуются,
+// поэтому ответ можно кэшировать бессрочно.
+//
+// @Summary Файл изображения или превью
+// @Description Ссылки на файлы приходят в url и thumbnail_url изображений продукта.
+// @Tags Images
+// @Produce image/jpeg,image/png,image/webp
+// @Param path path string true "Ключ файла в хранилище"
+// @Success 200 {file} file "Изображение"
+// @Failure 404 {object} problem.Problem "Изображение не найдено"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Router /images/{path} [get]
+func serveImage(c *fiber.Ctx) error {
+	key := c.Params("*")
+	file, err := imageStorage.Open(c.UserContext(), key)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errInvalidKey) {
+		return problem.New(fiber.StatusNotFound, "image_not_found", "Image not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, mime.TypeByExtension(path.Ext(key)))
+	c.Set(fiber.HeaderCacheControl, "public, max-age=31536000, immutable")
+	return c.SendStream(file)
+}
+
+// collectImageKeys читает пары (storage_key, thumbnail_key), чтобы удалить файлы
+// из хранилища после удаления строк.
+func collectImageKeys(rows pgx.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key, thumbnailKey string
+		if err := rows.Scan(&key, &thumbnailKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key, thumbnailKey)
+	}
+	return keys, rows.Err()
+}
+
+// removeImageFiles удаляет файлы без учёта контекста запроса: запись в БД уже
+// изменена, и оставлять файлы-сироты из-за отменённого запроса не нужно.
+func removeImageFiles(keys ...string) {
+	for _, key := range keys {
+		if err := imageStorage.Delete(context.Background(), key); err != nil {
+			log.Printf("failed to delete image %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Незнакомый kid может означать ротацию ключей в сервисе авторизации, поэтому
+// JWKS перечитывается, но не чаще этого интервала.
+const jwksMinRefetchInterval = 30 * time.Second
+
+var errUnknownKey = errors.New("unknown signing key")
+
+type verificationKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// jwksCache держит открытые ключи сервиса авторизации. Секретов бэкенду не нужно:
+// токены проверяются по ключам, опубликованным в /.well-known/jwks.json.
+//
+// Проверка токенов читает ключи под RLock; загрузка JWKS идёт без блокировки,
+// и одновременные запросы с незнакомым kid ждут одну общую загрузку.
+type jwksCache struct {
+	url     string
+	ttl     time.Duration
+	client  *http.Client
+	refresh singleflight.Group
+
+	mu        sync.RWMutex
+	keys      map[string]verificationKey
+	fetchedAt time.Time
+}
+
+var accessTokenKeys *jwksCache
+
+func newJWKSCache(url string, ttl time.Duration) *jwksCache {
+	return &jwksCache{url: url, ttl: ttl, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (c *jwksCache) key(ctx context.Context, kid string) (verificationKey, error) {
+	key, ok, needsFetch := c.lookup(kid)
+	if needsFetch {
+		// Загрузка не привязана к запросу, который её начал: её результат нужен
+		// всем ждущим. Сам запрос может перестать ждать по своему контексту
+		done := c.refresh.DoChan("jwks", func() (interface{}, error) {
+			// Пока запрос ждал своей очереди, ключи могли уже обновить
+			if _, _, needsFetch := c.lookup(kid); !needsFetch {
+				return nil, nil
+			}
+			return nil, c.fetch()
+		})
+		select {
+		case res := <-done:
+			if res.Err != nil {
+				// Сервис авторизации недоступен — продолжаем работать на известных ключах
+				log.Printf("jwks fetch failed: %v", res.Err)
+			}
+		case <-ctx.Done():
+			return verificationKey{}, ctx.Err()
+		}
+		key, ok, _ = c.lookup(kid)
+	}
+	if !ok {
+		return verificationKey{}, errUnknownKey
+	}
+	return key, nil
+}
+
+// lookup ищет ключ и сообщает, пора ли перечитать JWKS: кэш устарел или kid
+// незнаком, а с прошлой попытки прошло больше jwksMinRefetchInterval.
+func (c *jwksCache) lookup(kid string) (key verificationKey, ok, needsFetch bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key, ok = c.keys[kid]
+	sinceFetch := time.Since(c.fetchedAt)
+	return key, ok, sinceFetch > c.ttl || (!ok && sinceFetch > jwksMinRefetchInterval)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// fetch загружает JWKS и подменяет набор ключей целиком.
+func (c *jwksCache) fetch() error {
+	keys, err := c.download()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Даже неудачная попытка сдвигает время, чтобы не долбить сервис на каждом запросе
+	c.fetchedAt = time.Now()
+	if err != nil {
+		return err
+	}
+	c.keys = keys
+	return nil
+}
+
+func (c *jwksCache) download() (map[string]verificationKey, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]verificationKey, len(set.Keys))
+	for _, k := range set.Keys {
+		public, err := k.publicKey()
+		if err != nil {
+			log.Printf("jwks: skipping key %s: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = verificationKey{alg: k.Alg, key: public}
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch {
+	case k.Kty == "OKP" && k.Crv == "Ed25519" && k.Alg == "EdDSA":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case k.Kty == "RSA" && k.Alg == "RS256":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key %s/%s", k.Kty, k.Alg)
+	}
+}
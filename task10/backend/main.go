@@ -1,81 +1,56 @@
 package main
 
 import (
-	"database/sql"
-	"github.com/gofiber/adaptor/v2"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/swagger"
 	"github.com/gofiber/websocket/v2"
-	"github.com/graphql-go/graphql"
-	"github.com/graphql-go/handler"
-	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
 	"log"
-	_ "server/docs"
+	"shared/clientip"
+	"shared/problem/fiberproblem"
+	"time"
 )
 
-type ErrorResponse struct {
-	Error string `json:"error"`
-}
-
-var db *sql.DB
-
-func initDB() {
-	var err error
-	db, err = sql.Open("postgres", "host=db port=5432 user=postgres password=12345678 dbname=db sslmode=disable")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS products (
-		id SERIAL PRIMARY KEY,
-		name VARCHAR(255) NOT NULL,
-		price DECIMAL(10, 2) NOT NULL,
-		description TEXT,
-		categories TEXT[]
-	);
-	`)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
+var cfg *Config
 
 type Product struct {
 	ID          int      `json:"id"`
+	SKU         string   `json:"sku"`
 	Name        string   `json:"name"`
 	Price       float64  `json:"price"`
 	Description string   `json:"description"`
 	Categories  []string `json:"categories"`
+
+	Images []ProductImage `json:"images"`
+
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // @Summary Получение списка всех продуктов
+// @Description Ответ кэшируется в Redis; заголовок X-Cache показывает, HIT это или MISS.
 // @Tags Products
 // @Accept json
 // @Produce json
 // @Success 200 {array} Product "Успешный ответ"
-// @Failure 500 {object} ErrorResponse "Ошибка на сервере"
-// @Router /api/products [get]
+// @Header 200 {string} X-Cache "HIT или MISS"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Router /products [get]
 func getProducts(c *fiber.Ctx) error {
-	rows, err := db.Query("SELECT id, name, price, description, categories FROM products")
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
-	}
-	defer rows.Close()
+	ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+	defer cancel()
 
-	var products []Product
-	for rows.Next() {
-		var product Product
-		if err := rows.Scan(&product.ID, &product.Name, &product.Price, &product.Description, pq.Array(&product.Categories)); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
-		}
-		products = append(products, product)
+	data, hit, err := cachedProductsJSON(ctx)
+	if err != nil {
+		return err
 	}
 
-	if err := rows.Err(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+	c.Set("X-Cache", "MISS")
+	if hit {
+		c.Set("X-Cache", "HIT")
 	}
-
-	return c.JSON(products)
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(data)
 }
 
 // @Summary Добавить один или несколько продуктов
@@ -84,9 +59,15 @@ func getProducts(c *fiber.Ctx) error {
 // @Produce json
 // @Param products body []Product true "Данные продуктов"
 // @Success 200 {array} Product "Продукты успешно добавлены"
-// @Failure 400 {object} ErrorResponse "Некорректный запрос"
-// @Failure 500 {object} ErrorResponse "Ошибка на сервере"
-// @Router /api/products [post]
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 409 {object} problem.Problem "Продукт с таким SKU уже есть"
+// @Failure 422 {object} problem.Problem "Данные нарушают ограничения таблицы"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Security BearerAuth
+// @Router /products [post]
 func addProducts(c *fiber.Ctx) error {
 	var products []Product
 
@@ -95,18 +76,20 @@ func addProducts(c *fiber.Ctx) error {
 		// Если не получилось, пробуем одиночный объект
 		var singleProduct Product
 		if err := c.BodyParser(&singleProduct); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{Error: "Invalid request"})
+			return errInvalidRequest
 		}
 		products = append(products, singleProduct)
 	}
 
-	query := "INSERT INTO products (name, price, description, categories) VALUES ($1, $2, $3, $4) RETURNING id"
+	ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+	defer cancel()
 
-	for i := range products {
-		err := db.QueryRow(query, products[i].Name, products[i].Price, products[i].Description, pq.Array(products[i].Categories)).Scan(&products[i].ID)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
-		}
+	if len(products) == 0 {
+		return c.JSON(products)
+	}
+
+	if err := insertProducts(ctx, products); err != nil {
+		return err
 	}
 
 	return c.JSON(products)
@@ -119,90 +102,66 @@ func addProducts(c *fiber.Ctx) error {
 // @Param id path int true "ID продукта"
 // @Param product body Product true "Данные продукта"
 // @Success 200 {object} map[string]string "Продукт успешно обновлен"
-// @Failure 400 {object} ErrorResponse "Некорректный запрос"
-// @Failure 500 {object} ErrorResponse "Ошибка на сервере"
-// @Router /api/products/{id} [put]
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 404 {object} problem.Problem "Продукт не найден"
+// @Failure 409 {object} problem.Problem "Продукт с таким SKU уже есть"
+// @Failure 422 {object} problem.Problem "Данные нарушают ограничения таблицы"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Security BearerAuth
+// @Router /products/{id} [put]
 func updateProduct(c *fiber.Ctx) error {
-	id := c.Params("id")
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return errInvalidProductID
+	}
+
 	var product Product
 	if err := c.BodyParser(&product); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{Error: "Invalid request"})
+		return errInvalidRequest
 	}
 
-	query := "UPDATE products SET name=$1, price=$2, description=$3, categories=$4 WHERE id=$5"
-	_, err := db.Exec(query, product.Name, product.Price, product.Description, pq.Array(product.Categories), id)
+	ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+	defer cancel()
+
+	err = updateProductByID(ctx, id, product)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		return err
 	}
 	return c.JSON(fiber.Map{"message": "Product updated successfully"})
 }
 
 // @Summary Удалить продукт
+// @Description Продукт переносится в корзину и может быть восстановлен до окончания срока хранения.
 // @Tags Products
 // @Accept json
 // @Produce json
 // @Param id path int true "ID продукта"
 // @Success 200 {object} map[string]string "Продукт успешно удален"
-// @Failure 500 {object} ErrorResponse "Ошибка на сервере"
-// @Router /api/products/{id} [delete]
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 404 {object} problem.Problem "Продукт не найден"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Security BearerAuth
+// @Router /products/{id} [delete]
 func deleteProduct(c *fiber.Ctx) error {
-	id := c.Params("id")
-	query := "DELETE FROM products WHERE id=$1"
-	_, err := db.Exec(query, id)
+	id, err := c.ParamsInt("id")
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		return errInvalidProductID
 	}
-	return c.JSON(fiber.Map{"message": "Product deleted successfully"})
-}
 
-var productType = graphql.NewObject(
-	graphql.ObjectConfig{
-		Name: "Product",
-		Fields: graphql.Fields{
-			"id":          &graphql.Field{Type: graphql.Int},
-			"name":        &graphql.Field{Type: graphql.String},
-			"price":       &graphql.Field{Type: graphql.Float},
-			"description": &graphql.Field{Type: graphql.String},
-			"categories":  &graphql.Field{Type: graphql.NewList(graphql.String)},
-		},
-	},
-)
+	ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+	defer cancel()
 
-func createSchema() graphql.Schema {
-
-	rootQuery := graphql.NewObject(graphql.ObjectConfig{
-		Name: "Query",
-		Fields: graphql.Fields{
-			"products": &graphql.Field{
-				Type: graphql.NewList(productType),
-				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
-					rows, err := db.Query("SELECT id, name, price, description, categories FROM products")
-					if err != nil {
-						return nil, err
-					}
-					defer rows.Close()
-
-					var products []Product
-					for rows.Next() {
-						var product Product
-						if err := rows.Scan(&product.ID, &product.Name, &product.Price, &product.Description, pq.Array(&product.Categories)); err != nil {
-							return nil, err
-						}
-						products = append(products, product)
-					}
-					return products, nil
-				},
-			},
-		},
-	})
-
-	schema, err := graphql.NewSchema(graphql.SchemaConfig{
-		Query: rootQuery,
-	})
+	err = deleteProductByID(ctx, id)
 	if err != nil {
-		log.Fatalf("failed to create new schema, error: %v", err)
+		return err
 	}
-	return schema
+	return c.JSON(fiber.Map{"message": "Product deleted successfully"})
 }
 
 type Message struct {
@@ -212,7 +171,19 @@ type Message struct {
 
 var clients = make(map[*websocket.Conn]bool)
 
-var broadcast = make(chan Message)
+// В канал попадают сообщения чата (Message) и служебные события вроде ImportProgress.
+// Буфер сглаживает всплески, пока handleMessages пишет медленным клиентам.
+var broadcast = make(chan interface{}, 64)
+
+// publishEvent рассылает служебное событие, не дожидаясь handleMessages:
+// импорт держит открытую транзакцию, и медленный клиент /ws не должен её
+// задерживать. Если буфер полон, событие теряется.
+func publishEvent(event interface{}) {
+	select {
+	case broadcast <- event:
+	default:
+	}
+}
 
 func handleMessages() {
 	for {
@@ -226,46 +197,128 @@ func handleMessages() {
 	}
 }
 
+// @Summary Чат и события каталога
+// @Description Подключение по WebSocket (через nginx — ws://localhost:3000/ws). Клиент отправляет сообщения Message
+// @Description в формате JSON, сервер рассылает каждое сообщение всем подключённым клиентам в том же формате.
+// @Description Во время импорта сервер также рассылает события {"type": "import_progress", ...} с полями
+// @Description import_id, dry_run, processed, created, updated, failed и done. Если клиент превышает
+// @Description RATE_LIMIT_WS, соединение закрывается с кодом 1008.
+// @Tags Chat
+// @Success 101 {object} Message "Соединение переключено на WebSocket"
+// @Failure 426 {object} problem.Problem "Запрос без Upgrade: websocket"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Router /ws [get]
+func chat(c *websocket.Conn) {
+	// Регистрируем клиента
+	clients[c] = true
+	defer func() {
+		delete(clients, c)
+		c.Close()
+	}()
+	key, _ := c.Locals("rateLimitKey").(string)
+	for {
+		var msg Message
+		if err := c.ReadJSON(&msg); err != nil {
+			break
+		}
+		if !allowMessage(key) {
+			closeRateLimited(c)
+			break
+		}
+		broadcast <- msg
+	}
+}
+
+// @Summary Проверка доступности
+// @Tags Service
+// @Produce plain
+// @Success 200 {string} string "hello"
+// @Router /health [get]
+func health(c *fiber.Ctx) error {
+	return c.SendString("hello")
+}
+
+// setupRoutes регистрирует все маршруты API. Каждый маршрут, кроме /swagger,
+// должен быть описан в аннотациях; это проверяет TestRoutesMatchSpec.
+func setupRoutes(app *fiber.App) {
+	app.Use(authMiddleware)
+
+	viewer, editor, admin := requireRole(roleViewer), requireRole(roleEditor), requireRole(roleAdmin)
+	read, write := rateLimit("read", cfg.RateLimitRead), rateLimit("write", cfg.RateLimitWrite)
+	app.Get("/products", read, getProducts)
+	app.Post("/products", write, editor, addProducts)
+	app.Get("/products/export", read, exportProducts)
+	app.Get("/cache/stats", read, admin, getCacheStats)
+	app.Get("/products/trash", read, viewer, getTrashedProducts)
+	app.Post("/products/:id/restore", write, editor, restoreProduct)
+	app.Post("/products/import", write, admin, importProducts)
+	app.Post("/products/:id/images", write, editor, uploadProductImages)
+	app.Delete("/products/:id/images/:imageId", write, editor, deleteProductImage)
+	app.Get("/images/*", read, serveImage)
+	app.Get("/products/:id/history", read, viewer, getProductHistory)
+	app.Post("/products/:id/revert/:version", write, admin, revertProduct)
+	app.Put("/products/:id", write, editor, updateProduct)
+	app.Delete("/products/:id", write, editor, deleteProduct)
+	app.Get("/health", health)
+
+	schema := createSchema()
+	app.Post("/graphql", rateLimit("graphql", cfg.RateLimitGraphQL), newGraphQLHandler(schema))
+
+	app.Get("/ws", func(c *fiber.Ctx) error {
+		// После апгрейда контекст запроса недоступен, поэтому клиента для лимита определяем заранее
+		c.Locals("rateLimitKey", rateLimitKey(c.UserContext(), clientIP(c)))
+		return c.Next()
+	}, websocket.New(chat))
+
+	app.Get("/swagger/doc.json", serveSpec)
+	app.Get("/swagger/schema.graphql", serveGraphQLSchema(schema))
+	app.Get("/swagger/*", swagger.HandlerDefault)
+}
+
 // @title TEST API
 // @version 1.0
-// @BasePath /
+// @description API каталога. Через nginx все маршруты доступны с префиксом /api.
+// @description Схема GraphQL на языке SDL — /api/swagger/schema.graphql, сообщения чата /ws — модель main.Message.
+// @BasePath /api
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+// @description Access-токен сервиса авторизации: "Bearer <token>"
 func main() {
+	cfg = LoadConfig()
+
 	initDB()
 	defer db.Close()
 
-	app := fiber.New()
-	app.Get("/products", getProducts)
-	app.Post("/products", addProducts)
-	app.Put("/products/:id", updateProduct)
-	app.Delete("/products/:id", deleteProduct)
-	app.Get("/health", func(c *fiber.Ctx) error { return c.SendString("hello") })
+	accessTokenKeys = newJWKSCache(cfg.JWKSURL, cfg.JWKSCacheTTL)
 
-	schema := createSchema()
-	graphqlHandler := handler.New(&handler.Config{
-		Schema: &schema,
-		Pretty: true,
-	})
-	app.All("/graphql", adaptor.HTTPHandler(graphqlHandler))
-
-	go handleMessages()
+	var err error
+	trustedProxies, err = clientip.ParseProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	app.Get("/ws", websocket.New(func(c *websocket.Conn) {
-		// Регистрируем клиента
-		clients[c] = true
-		defer func() {
-			delete(clients, c)
-			c.Close()
-		}()
-		for {
-			var msg Message
-			if err := c.ReadJSON(&msg); err != nil {
-				break
-			}
-			broadcast <- msg
+	rateLimits = newMemoryRateStore()
+	if cfg.RedisURL != "" {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}))
+		rdb := redis.NewClient(opts)
+		productsCache = newProductCache(rdb, cfg.ProductsCacheTTL)
+		rateLimits = redisRateStore{rdb: rdb}
+	}
 
-	app.Get("/swagger/*", swagger.HandlerDefault)
+	imageStorage, err = NewLocalStorage(cfg.ImagesDir, cfg.ImagesBaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app := fiber.New(fiber.Config{BodyLimit: cfg.BodyLimit, ErrorHandler: fiberproblem.ErrorHandler(cfg.Production(), domainProblems...)})
+	setupRoutes(app)
+
+	go handleMessages()
+	go runTrashPurger(cfg.TrashPurgeInterval)
 
 	log.Println("Server running on port 8080")
 	log.Fatal(app.Listen(":8080"))
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"shared/problem"
+	"shared/problem/fiberproblem"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+var (
+	errInvalidRequest   = problem.New(fiber.StatusBadRequest, "bad_request", "Invalid request")
+	errInvalidProductID = problem.New(fiber.StatusBadRequest, "invalid_product_id", "Invalid product id")
+	errInvalidToken     = problem.New(fiber.StatusUnauthorized, "invalid_token", "Invalid token")
+)
+
+// domainProblems — ошибки хранилища и авторизации, которые видит клиент.
+var domainProblems = []fiberproblem.Mapping{
+	{Err: errProductNotFound, Problem: problem.New(fiber.StatusNotFound, "product_not_found", "Product not found")},
+	{Err: errAuditVersionNotFound, Problem: problem.New(fiber.StatusNotFound, "version_not_found", "Version not found")},
+	{Err: errUnauthorized, Problem: problem.New(fiber.StatusUnauthorized, "unauthorized", "Authorization header is required")},
+	{Err: errForbidden, Problem: problem.New(fiber.StatusForbidden, "forbidden", "Insufficient role")},
+}
+
+// writeProblem отвечает Problem из обычного http-обработчика (GraphQL за adaptor).
+func writeProblem(w http.ResponseWriter, r *http.Request, p *problem.Problem) {
+	resp := *p
+	resp.Instance = r.URL.Path
+	w.Header().Set("Content-Type", problem.ContentType)
+	w.WriteHeader(resp.Status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// formatGraphQLError приводит ошибки резолверов к тем же кодам, что и REST:
+// code и status уходят в extensions, а текст внутренних ошибок скрывается так же.
+// Ошибки разбора и проверки запроса возвращаются как есть.
+func formatGraphQLError(err error) gqlerrors.FormattedError {
+	formatted := gqlerrors.FormatError(err)
+	gqlErr, ok := err.(*gqlerrors.Error)
+	if !ok || gqlErr.OriginalError == nil {
+		return formatted
+	}
+	p := fiberproblem.From(gqlErr.OriginalError, cfg.Production(), domainProblems...)
+	formatted.Message = p.Detail
+	if formatted.Message == "" {
+		formatted.Message = p.Title
+	}
+	formatted.Extensions = map[string]interface{}{"code": p.Code, "status": p.Status}
+	return formatted
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"shared/problem"
+	"shared/problem/fiberproblem"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestDomainProblems(t *testing.T) {
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+	cfg = &Config{Environment: "production"}
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"problem", problem.New(fiber.StatusBadRequest, "invalid_request", "Bad body"), fiber.StatusBadRequest, "invalid_request"},
+		{"wrapped problem", fmt.Errorf("decode: %w", errInvalidRequest), errInvalidRequest.Status, errInvalidRequest.Code},
+		{"product not found", fmt.Errorf("get: %w", errProductNotFound), fiber.StatusNotFound, "product_not_found"},
+		{"version not found", errAuditVersionNotFound, fiber.StatusNotFound, "version_not_found"},
+		{"unauthorized", errUnauthorized, fiber.StatusUnauthorized, "unauthorized"},
+		{"forbidden", errForbidden, fiber.StatusForbidden, "forbidden"},
+		{"fiber error", fiber.ErrRequestEntityTooLarge, fiber.StatusRequestEntityTooLarge, "request_entity_too_large"},
+		{"no rows", pgx.ErrNoRows, fiber.StatusNotFound, "not_found"},
+		{"unique", &pgconn.PgError{Code: "23505"}, fiber.StatusConflict, "already_exists"},
+		{"check", fmt.Errorf("update: %w", &pgconn.PgError{Code: "23514"}), fiber.StatusUnprocessableEntity, "constraint_violation"},
+		{"statement timeout", &pgconn.PgError{Code: "57014"}, fiber.StatusServiceUnavailable, "timeout"},
+		{"other", fmt.Errorf("boom"), fiber.StatusInternalServerError, "internal_error"},
+	}
+	for _, tt := range tests {
+		p := fiberproblem.From(tt.err, cfg.Production(), domainProblems...)
+		if p.Status != tt.status || p.Code != tt.code {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, p.Status, p.Code, tt.status, tt.code)
+		}
+	}
+
+	if p := fiberproblem.From(fmt.Errorf("boom"), cfg.Production(), domainProblems...); p.Detail != "" {
+		t.Errorf("production: internal detail %q", p.Detail)
+	}
+}
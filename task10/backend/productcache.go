@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// productCache хранит в Redis готовый JSON списка продуктов, общий для всех реплик.
+//
+// Ключ списка содержит номер поколения каталога. Каждая закоммиченная запись
+// увеличивает поколение, и все реплики сразу начинают читать новый ключ.
+// Поколение читается до запроса в БД, поэтому список, собранный параллельно
+// с записью, попадает в уже устаревший ключ и никому не достанется.
+type productCache struct {
+	rdb *redis.Client
+	ttl time.Duration
+
+	hits          atomic.Int64
+	misses        atomic.Int64
+	failures      atomic.Int64
+	invalidations atomic.Int64
+}
+
+// CacheStats — счётчики кэша этой реплики с момента запуска.
+type CacheStats struct {
+	Instance      string  `json:"instance"`
+	Enabled       bool    `json:"enabled"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	Failures      int64   `json:"failures"`
+	Invalidations int64   `json:"invalidations"`
+	HitRatio      float64 `json:"hit_ratio"`
+}
+
+const (
+	productsGenerationKey = "products:generation"
+	productsListKeyPrefix = "products:list:"
+)
+
+// productsCache == nil означает, что кэш выключен (REDIS_URL не задан).
+var productsCache *productCache
+
+func newProductCache(rdb *redis.Client, ttl time.Duration) *productCache {
+	return &productCache{rdb: rdb, ttl: ttl}
+}
+
+// cachedProductsJSON возвращает JSON списка продуктов и признак попадания в кэш.
+// Если Redis недоступен, список читается из БД напрямую.
+func cachedProductsJSON(ctx context.Context) ([]byte, bool, error) {
+	if productsCache == nil {
+		data, err := loadProductsJSON(ctx)
+		return data, false, err
+	}
+	return productsCache.get(ctx)
+}
+
+// cachedProducts — то же для резолверов GraphQL, которым нужны сами продукты.
+func cachedProducts(ctx context.Context) ([]Product, error) {
+	if productsCache == nil {
+		return listProducts(ctx)
+	}
+	data, _, err := productsCache.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var list []Product
+	err = json.Unmarshal(data, &list)
+	return list, err
+}
+
+func loadProductsJSON(ctx context.Context) ([]byte, error) {
+	list, err := listProducts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(list)
+}
+
+func (pc *productCache) get(ctx context.Context) ([]byte, bool, error) {
+	generation, err := pc.rdb.Get(ctx, productsGenerationKey).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		pc.failures.Add(1)
+		log.Printf("product cache unavailable: %v", err)
+		data, err := loadProductsJSON(ctx)
+		return data, false, err
+	}
+	key := productsListKeyPrefix + strconv.FormatInt(generation, 10)
+
+	data, err := pc.rdb.Get(ctx, key).Bytes()
+	if err == nil {
+		pc.hits.Add(1)
+		return data, true, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		pc.failures.Add(1)
+		log.Printf("product cache unavailable: %v", err)
+	}
+
+	pc.misses.Add(1)
+	data, err = loadProductsJSON(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := pc.rdb.Set(ctx, key, data, pc.ttl).Err(); err != nil {
+		pc.failures.Add(1)
+		log.Printf("failed to cache products: %v", err)
+	}
+	return data, false, nil
+}
+
+// invalidate вызывается после коммита изменений каталога.
+func (pc *productCache) invalidate(ctx context.Context) {
+	// Коммит уже прошёл: сброс кэша не должен сорваться из-за отмены запроса
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.DB.QueryTimeout)
+	defer cancel()
+
+	pc.invalidations.Add(1)
+	if err := pc.rdb.Incr(ctx, productsGenerationKey).Err(); err != nil {
+		pc.failures.Add(1)
+		log.Printf("failed to invalidate product cache: %v", err)
+	}
+}
+
+func invalidateProducts(ctx context.Context) {
+	if productsCache != nil {
+		productsCache.invalidate(ctx)
+	}
+}
+
+// productTx выполняет изменение каталога в транзакции и после коммита сбрасывает кэш.
+func productTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	if err := pgx.BeginFunc(ctx, db, fn); err != nil {
+		return err
+	}
+	invalidateProducts(ctx)
+	return nil
+}
+
+func (pc *productCache) stats() CacheStats {
+	instance, _ := os.Hostname()
+	stats := CacheStats{Instance: instance, Enabled: pc != nil}
+	if pc == nil {
+		return stats
+	}
+	stats.Hits = pc.hits.Load()
+	stats.Misses = pc.misses.Load()
+	stats.Failures = pc.failures.Load()
+	stats.Invalidations = pc.invalidations.Load()
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// @Summary Статистика кэша продуктов
+// @Description Счётчики попаданий и промахов реплики, обработавшей запрос.
+// @Tags Products
+// @Produce json
+// @Success 200 {object} CacheStats "Статистика кэша"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Security BearerAuth
+// @Router /cache/stats [get]
+func getCacheStats(c *fiber.Ctx) error {
+	return c.JSON(productsCache.stats())
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"shared/clientip"
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Ограничение частоты запросов — token bucket: в корзине до Burst токенов,
+// за Period добавляется Burst токенов, каждый запрос забирает один.
+// Корзина заводится на группу маршрутов и клиента: пользователя из токена
+// или, для анонимных запросов, IP-адрес.
+
+// RateLimit — лимит группы маршрутов. Нулевой Burst выключает лимит.
+type RateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// parseRateLimit разбирает значение вида "60/1m"; "off" выключает лимит.
+func parseRateLimit(value string) (RateLimit, error) {
+	if value == "off" {
+		return RateLimit{}, nil
+	}
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected <requests>/<period>", value)
+	}
+	burst, err := strconv.Atoi(count)
+	if err != nil || burst <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: bad request count", value)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d < time.Millisecond {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: period must be at least 1ms", value)
+	}
+	return RateLimit{Burst: burst, Period: d}, nil
+}
+
+// perMilli — скорость пополнения корзины в токенах за миллисекунду.
+func (l RateLimit) perMilli() float64 {
+	return float64(l.Burst) / float64(l.Period.Milliseconds())
+}
+
+// rateDecision — результат списания токена.
+type rateDecision struct {
+	Allowed   bool
+	Remaining int
+	// Через сколько корзина наполнится полностью
+	Reset time.Duration
+	// Через сколько появится следующий токен; имеет смысл, если запрос отклонён
+	RetryAfter time.Duration
+}
+
+func decide(l RateLimit, allowed bool, tokens float64) rateDecision {
+	rate := l.perMilli()
+	d := rateDecision{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(l.Burst)-tokens)/rate) * time.Millisecond,
+	}
+	if !allowed {
+		d.RetryAfter = time.Duration((1-tokens)/rate) * time.Millisecond
+	}
+	return d
+}
+
+type rateStore interface {
+	take(ctx context.Context, key string, limit RateLimit) (rateDecision, error)
+}
+
+// takeTokenScript списывает токен атомарно. Время берётся у Redis, чтобы
+// часы реплик не влияли на пополнение.
+var takeTokenScript = redis.NewScript(`
+local now = redis.call('TIME')
+local ms = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or ms
+tokens = math.min(burst, tokens + math.max(0, ms - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+    tokens = tokens - 1
+    allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ms)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return {allowed, tostring(tokens)}
+`)
+
+// redisRateStore — корзины в Redis, общие для всех реплик.
+type redisRateStore struct {
+	rdb *redis.Client
+}
+
+func (s redisRateStore) take(ctx context.Context, key string, limit RateLimit) (rateDecision, error) {
+	res, err := takeTokenScript.Run(ctx, s.rdb, []string{"ratelimit:" + key},
+		limit.Burst, limit.perMilli(), limit.Period.Milliseconds(),
+	).Slice()
+	if err != nil {
+		return rateDecision{}, err
+	}
+	if len(res) != 2 {
+		return rateDecision{}, fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	allowed, _ := res[0].(int64)
+	raw, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return rateDecision{}, err
+	}
+	return decide(limit, allowed == 1, tokens), nil
+}
+
+type bucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+// memoryRateStore — корзины в памяти процесса, если Redis не настроен.
+// С несколькими репликами каждая считает запросы сама.
+type memoryRateStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newMemoryRateStore() *memoryRateStore {
+	s := &memoryRateStore{buckets: make(map[string]*bucket)}
+	go s.cleanup(time.Minute)
+	return s
+}
+
+func (s *memoryRateStore) take(_ context.Context, key string, limit RateLimit) (rateDecision, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), ts: now}
+		s.buckets[key] = b
+	}
+	elapsed := float64(now.Sub(b.ts).Milliseconds())
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.perMilli())
+	b.ts = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return decide(limit, allowed, b.tokens), nil
+}
+
+// cleanup удаляет давно не использованные корзины: за час простоя любая
+// корзина с разумным периодом успевает наполниться.
+func (s *memoryRateStore) cleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mu.Lock()
+		for key, b := range s.buckets {
+			if time.Since(b.ts) > time.Hour {
+				delete(s.buckets, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+var rateLimits rateStore
+
+// allowRequest списывает токен группы group для клиента key. Если хранилище
+// недоступно, запрос пропускается: лимит не должен ронять API вместе с Redis.
+func allowRequest(ctx context.Context, group string, limit RateLimit, key string) (rateDecision, bool) {
+	d, err := rateLimits.take(ctx, group+":"+key, limit)
+	if err != nil {
+		log.Printf("rate limit unavailable: %v", err)
+		return rateDecision{}, false
+	}
+	return d, true
+}
+
+// rateLimitKey — пользователь из токена, а для анонимных запросов IP клиента.
+func rateLimitKey(ctx context.Context, ip string) string {
+	if p := principalFromContext(ctx); p != nil {
+		return "user:" + strconv.Itoa(p.UserID)
+	}
+	return "ip:" + ip
+}
+
+// setRateLimitHeaders выставляет заголовки RateLimit-* (draft-ietf-httpapi-ratelimit-headers).
+func setRateLimitHeaders(c *fiber.Ctx, limit RateLimit, d rateDecision) {
+	c.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, int(limit.Period.Seconds())))
+	c.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	c.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	c.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimit ограничивает частоту запросов к группе маршрутов. Ставится
+// после authMiddleware, чтобы авторизованные пользователи считались по ID.
+func rateLimit(group string, limit RateLimit) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if limit.Burst == 0 {
+			return c.Next()
+		}
+		ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+		d, ok := allowRequest(ctx, group, limit, rateLimitKey(ctx, clientIP(c)))
+		cancel()
+		if !ok {
+			return c.Next()
+		}
+		setRateLimitHeaders(c, limit, d)
+		if !d.Allowed {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(max(1, ceilSeconds(d.RetryAfter))))
+			return problem.New(fiber.StatusTooManyRequests, "rate_limited", "Too many requests")
+		}
+		return c.Next()
+	}
+}
+
+// trustedProxies — адреса nginx, которым разрешено передавать IP клиента в X-Forwarded-For.
+var trustedProxies clientip.Proxies
+
+func clientIP(c *fiber.Ctx) string {
+	var forwardedFor []string
+	for _, v := range c.Request().Header.PeekAll(fiber.HeaderXForwardedFor) {
+		forwardedFor = append(forwardedFor, string(v))
+	}
+	return trustedProxies.ClientIP(c.Context().RemoteIP(), forwardedFor)
+}
+
+// allowMessage ограничивает сообщения чата одного клиента в /ws.
+func allowMessage(key string) bool {
+	if cfg.RateLimitWS.Burst == 0 {
+		return true
+	}
+	ctx, cancel := cfg.DB.QueryContext(context.Background())
+	defer cancel()
+	d, ok := allowRequest(ctx, "ws", cfg.RateLimitWS, key)
+	return !ok || d.Allowed
+}
+
+// closeRateLimited закрывает соединение с кодом 1008. WriteControl можно
+// вызывать параллельно с рассылкой из handleMessages.
+func closeRateLimited(c *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded")
+	if err := c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		log.Printf("failed to close rate limited websocket: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for value, want := range map[string]RateLimit{
+		"60/1m":  {Burst: 60, Period: time.Minute},
+		"5/10ms": {Burst: 5, Period: 10 * time.Millisecond},
+		"off":    {},
+	} {
+		got, err := parseRateLimit(value)
+		if err != nil || got != want {
+			t.Errorf("parseRateLimit(%q) = %+v, %v, want %+v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"60", "0/1m", "-1/1m", "x/1m", "60/", "60/1µs", "60/0s"} {
+		if _, err := parseRateLimit(value); err == nil {
+			t.Errorf("parseRateLimit(%q): expected error", value)
+		}
+	}
+}
+
+// rewind сдвигает время последнего списания назад, будто прошло elapsed.
+func rewind(s *memoryRateStore, key string, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[key].ts = s.buckets[key].ts.Add(-elapsed)
+}
+
+func TestMemoryRateStoreRefill(t *testing.T) {
+	s := &memoryRateStore{buckets: make(map[string]*bucket)}
+	limit := RateLimit{Burst: 4, Period: time.Minute}
+	ctx := context.Background()
+
+	for i := 3; i >= 0; i-- {
+		d, _ := s.take(ctx, "ip", limit)
+		if !d.Allowed || d.Remaining != i {
+			t.Fatalf("request %d: got %+v, want allowed with %d remaining", 4-i, d, i)
+		}
+	}
+	d, _ := s.take(ctx, "ip", limit)
+	if d.Allowed {
+		t.Fatal("request over burst allowed")
+	}
+	// Токен появляется раз в Period/Burst
+	if d.RetryAfter <= 0 || d.RetryAfter > 15*time.Second {
+		t.Errorf("retry after %v, want up to 15s", d.RetryAfter)
+	}
+	if d.Reset <= 45*time.Second || d.Reset > time.Minute {
+		t.Errorf("reset %v, want close to a minute", d.Reset)
+	}
+
+	// Другой ключ считается отдельно
+	if d, _ := s.take(ctx, "other", limit); !d.Allowed {
+		t.Error("separate key limited")
+	}
+
+	// За половину периода возвращается половина корзины
+	rewind(s, "ip", 30*time.Second)
+	for i := 0; i < 2; i++ {
+		if d, _ := s.take(ctx, "ip", limit); !d.Allowed {
+			t.Fatalf("request %d after refill rejected", i+1)
+		}
+	}
+	if d, _ := s.take(ctx, "ip", limit); d.Allowed {
+		t.Fatal("refill exceeded elapsed time")
+	}
+
+	// После долгого простоя корзина не переполняется сверх Burst
+	rewind(s, "ip", time.Hour)
+	d, _ = s.take(ctx, "ip", limit)
+	if !d.Allowed || d.Remaining != limit.Burst-1 {
+		t.Fatalf("after idle: got %+v, want %d remaining", d, limit.Burst-1)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/swaggo/swag"
+)
+
+// routeParam — параметр пути в синтаксисе fiber (:id), в спецификации он пишется как {id}.
+// Хвост пути (*) описывается в спецификации параметром {path}.
+var routeParam = regexp.MustCompile(`:(\w+)`)
+
+func specPath(route string) string {
+	return strings.Replace(routeParam.ReplaceAllString(route, "{$1}"), "*", "{path}", 1)
+}
+
+// TestRoutesMatchSpec сверяет зарегистрированные маршруты с аннотациями swag:
+// спецификация строится из исходников тем же парсером, что и swag init, поэтому
+// тест не зависит от того, сгенерирован ли каталог docs.
+func TestRoutesMatchSpec(t *testing.T) {
+	// Problem описан в общем модуле shared: парсер смотрит в зависимости, но только в него
+	parser := swag.New(swag.SetDebugger(log.New(io.Discard, "", 0)), swag.SetParseDependency(1), swag.SetPackagePrefix("server,shared"))
+	if err := parser.ParseAPI(".", "main.go", 100); err != nil {
+		t.Fatalf("parse annotations: %v", err)
+	}
+	documented := map[string]bool{}
+	for path, item := range parser.GetSwagger().Paths.Paths {
+		ops := map[string]bool{
+			http.MethodGet:    item.Get != nil,
+			http.MethodPost:   item.Post != nil,
+			http.MethodPut:    item.Put != nil,
+			http.MethodPatch:  item.Patch != nil,
+			http.MethodDelete: item.Delete != nil,
+		}
+		for method, ok := range ops {
+			if ok {
+				documented[method+" "+path] = true
+			}
+		}
+	}
+
+	// Нулевые лимиты выключены, остальная конфигурация маршрутам не нужна
+	cfg = &Config{}
+	app := fiber.New()
+	setupRoutes(app)
+	registered := map[string]bool{}
+	for _, route := range app.GetRoutes(true) {
+		// HEAD fiber добавляет к каждому GET сам; Swagger UI в спецификацию не входит
+		if route.Method == http.MethodHead || strings.HasPrefix(route.Path, "/swagger/") {
+			continue
+		}
+		registered[route.Method+" "+specPath(route.Path)] = true
+	}
+
+	for _, route := range difference(registered, documented) {
+		t.Errorf("route %s is not documented", route)
+	}
+	for _, route := range difference(documented, registered) {
+		t.Errorf("documented route %s is not registered", route)
+	}
+}
+
+func difference(a, b map[string]bool) []string {
+	var diff []string
+	for k := range a {
+		if !b[k] {
+			diff = append(diff, k)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var errProductNotFound = errors.New("product not found")
+
+var productColumns = []string{"id", "sku", "name", "price", "description", "categories"}
+
+func scanProduct(row pgx.CollectableRow) (Product, error) {
+	var product Product
+	err := row.Scan(&product.ID, &product.SKU, &product.Name, &product.Price, &product.Description, &product.Categories, &product.DeletedAt)
+	return product, err
+}
+
+func listProducts(ctx context.Context) ([]Product, error) {
+	return queryProducts(ctx, stmtSelectProducts)
+}
+
+func listTrashedProducts(ctx context.Context) ([]Product, error) {
+	return queryProducts(ctx, stmtSelectTrash)
+}
+
+func queryProducts(ctx context.Context, stmt string) ([]Product, error) {
+	rows, err := db.Query(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	products, err := pgx.CollectRows(rows, scanProduct)
+	if err != nil {
+		return nil, err
+	}
+	if err := attachImages(ctx, products); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// insertProducts сохраняет продукты и проставляет им ID. Одиночная вставка идёт
+// подготовленным запросом, пачка — через COPY.
+func insertProducts(ctx context.Context, products []Product) error {
+	return productTx(ctx, func(tx pgx.Tx) error {
+		if len(products) == 1 {
+			p := &products[0]
+			if err := tx.QueryRow(ctx, stmtInsertProduct, p.SKU, p.Name, p.Price, p.Description, p.Categories).Scan(&p.ID); err != nil {
+				return err
+			}
+			return recordAudit(ctx, tx, p.ID, auditCreate, nil, snapshotOf(*p, false), nil)
+		}
+
+		if err := copyProducts(ctx, tx, products); err != nil {
+			return err
+		}
+		return copyAuditCreates(ctx, tx, products)
+	})
+}
+
+// copyProducts заранее резервирует ID в последовательности, так как COPY
+// не умеет возвращать сгенерированные значения.
+func copyProducts(ctx context.Context, tx pgx.Tx, products []Product) error {
+	rows, err := tx.Query(ctx,
+		"SELECT nextval(pg_get_serial_sequence('products', 'id')) FROM generate_series(1, $1)",
+		len(products),
+	)
+	if err != nil {
+		return err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		products[i].ID = ids[i]
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"products"}, productColumns,
+		pgx.CopyFromSlice(len(products), func(i int) ([]any, error) {
+			p := products[i]
+			return []any{p.ID, nullIfEmpty(p.SKU), p.Name, p.Price, p.Description, p.Categories}, nil
+		}),
+	)
+	return err
+}
+
+func updateProductByID(ctx context.Context, id int, product Product) error {
+	return productTx(ctx, func(tx pgx.Tx) error {
+		before, err := lockProduct(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if before.Deleted {
+			return errProductNotFound
+		}
+
+		_, err = tx.Exec(ctx, stmtUpdateProduct, product.SKU, product.Name, product.Price, product.Description, product.Categories, id)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, id, auditUpdate, before, snapshotOf(product, false), nil)
+	})
+}
+
+// deleteProductByID переносит продукт в корзину; окончательно он удаляется purgeTrash.
+func deleteProductByID(ctx context.Context, id int) error {
+	return setProductDeleted(ctx, id, true)
+}
+
+func restoreProductByID(ctx context.Context, id int) error {
+	return setProductDeleted(ctx, id, false)
+}
+
+// setProductDeleted переносит продукт в корзину или обратно. Если продукт уже
+// в нужном состоянии, возвращает errProductNotFound.
+func setProductDeleted(ctx context.Context, id int, deleted bool) error {
+	stmt, operation := stmtRestoreProduct, auditRestore
+	if deleted {
+		stmt, operation = stmtDeleteProduct, auditDelete
+	}
+
+	return productTx(ctx, func(tx pgx.Tx) error {
+		before, err := lockProduct(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if before.Deleted == deleted {
+			return errProductNotFound
+		}
+
+		if _, err := tx.Exec(ctx, stmt, id); err != nil {
+			return err
+		}
+		after := *before
+		after.Deleted = deleted
+		return recordAudit(ctx, tx, id, operation, before, &after, nil)
+	})
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"shared/problem"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Ключ advisory-блокировки, чтобы корзину чистила только одна реплика за раз.
+const trashPurgeLockID = 7301
+
+// @Summary Список продуктов в корзине
+// @Tags Trash
+// @Produce json
+// @Success 200 {array} Product "Удалённые продукты, последние удалённые первыми"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Security BearerAuth
+// @Router /products/trash [get]
+func getTrashedProducts(c *fiber.Ctx) error {
+	ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+	defer cancel()
+
+	products, err := listTrashedProducts(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(products)
+}
+
+// @Summary Восстановить продукт из корзины
+// @Tags Trash
+// @Produce json
+// @Param id path int true "ID продукта"
+// @Success 200 {object} map[string]string "Продукт восстановлен"
+// @Failure 400 {object} problem.Problem "Некорректный запрос"
+// @Failure 404 {object} problem.Problem "Продукта нет в корзине"
+// @Failure 401 {object} problem.Problem "Требуется авторизация"
+// @Failure 403 {object} problem.Problem "Недостаточно прав"
+// @Failure 429 {object} problem.Problem "Слишком много запросов"
+// @Failure 500 {object} problem.Problem "Ошибка на сервере"
+// @Security BearerAuth
+// @Router /products/{id}/restore [post]
+func restoreProduct(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return errInvalidProductID
+	}
+
+	ctx, cancel := cfg.DB.QueryContext(c.UserContext())
+	defer cancel()
+
+	err = restoreProductByID(ctx, id)
+	if errors.Is(err, errProductNotFound) {
+		return problem.New(fiber.StatusNotFound, "product_not_in_trash", "Product is not in trash")
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"message": "Product restored successfully"})
+}
+
+func runTrashPurger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.BulkTimeout)
+		purged, err := purgeTrash(ctx, cfg.TrashRetention)
+		cancel()
+		if err != nil {
+			log.Printf("trash purge failed: %v", err)
+		} else if purged > 0 {
+			log.Printf("trash purge: %d products removed", purged)
+		}
+	}
+}
+
+// purgeTrash окончательно удаляет продукты, пролежавшие в корзине дольше retention,
+// вместе с файлами их изображений.
+func purgeTrash(ctx context.Context, retention time.Duration) (int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", trashPurgeLockID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	seconds := int64(retention.Seconds())
+	rows, err := tx.Query(ctx, `
+		SELECT i.storage_key, i.thumbnail_key
+		FROM product_images i JOIN products p ON p.id = i.product_id
+		WHERE p.deleted_at < NOW() - $1 * INTERVAL '1 second'`, seconds)
+	if err != nil {
+		return 0, err
+	}
+	keys, err := collectImageKeys(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	tag, err := tx.Exec(ctx, "DELETE FROM products WHERE deleted_at < NOW() - $1 * INTERVAL '1 second'", seconds)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() > 0 {
+		invalidateProducts(ctx)
+	}
+
+	removeImageFiles(keys...)
+	return tag.RowsAffected(), nil
+}